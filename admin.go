@@ -0,0 +1,221 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+)
+
+// AdminServer serves the state of a client as JSON and lets operators refresh,
+// (un)subscribe and flush it. Every request needs the bearer token.
+//
+//	GET  /services                        known services
+//	GET  /services/{service}              a service with its instances
+//	POST /services/{service}/refresh      fetch a service from Nacos
+//	POST /services/{service}/subscribe    subscribe to its pushes
+//	POST /services/{service}/unsubscribe  unsubscribe from its pushes
+//	POST /refresh                         list the services of Nacos
+//	POST /cache/flush[?services=true]     drop the cached answers, and services
+type AdminServer struct {
+	Addr  string
+	Token string
+	vc    *NacosClient
+
+	lock   sync.Mutex
+	ln     net.Listener
+	server *http.Server
+}
+
+// ServiceStatus is what the client knows about a service.
+type ServiceStatus struct {
+	Name       string         `json:"name"`
+	Registered bool           `json:"registered"` // listed by Nacos
+	Cached     bool           `json:"cached"`
+	Subscribed bool           `json:"subscribed"`
+	Instances  int            `json:"instances"`
+	LastSync   *time.Time     `json:"lastSync,omitempty"` // last fetched or pushed
+	Service    *model.Service `json:"service,omitempty"`
+}
+
+func NewAdminServer(addr, token string, vc *NacosClient) *AdminServer {
+	return &AdminServer{Addr: addr, Token: token, vc: vc}
+}
+
+// Start listens on Addr, it is a no-op while listening.
+func (as *AdminServer) Start() error {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+	if as.ln != nil {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", as.Addr)
+	if err != nil {
+		return err
+	}
+	as.ln = ln
+	as.server = &http.Server{Handler: as.handler(), ReadHeaderTimeout: 5 * time.Second}
+	go as.server.Serve(ln)
+	log.Infof("Admin endpoint listening on %s", ln.Addr())
+	return nil
+}
+
+// Stop closes the listener, it is a no-op while stopped.
+func (as *AdminServer) Stop() error {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+	if as.ln == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := as.server.Shutdown(ctx)
+	as.ln, as.server = nil, nil
+	return err
+}
+
+func (as *AdminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /services", as.listServices)
+	mux.HandleFunc("GET /services/{service}", as.getService)
+	mux.HandleFunc("POST /services/{service}/refresh", as.refreshService)
+	mux.HandleFunc("POST /services/{service}/subscribe", as.subscribe)
+	mux.HandleFunc("POST /services/{service}/unsubscribe", as.unsubscribe)
+	mux.HandleFunc("POST /refresh", as.refresh)
+	mux.HandleFunc("POST /cache/flush", as.flush)
+	return as.authorized(mux)
+}
+
+func (as *AdminServer) authorized(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + as.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nacos"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (as *AdminServer) listServices(w http.ResponseWriter, r *http.Request) {
+	names := as.vc.serviceKeys()
+	statuses := make([]ServiceStatus, 0, len(names))
+	for _, name := range names {
+		status := as.status(name)
+		status.Service = nil
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (as *AdminServer) getService(w http.ResponseWriter, r *http.Request) {
+	as.writeStatus(w, r.PathValue("service"))
+}
+
+func (as *AdminServer) refreshService(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("service")
+	if _, err := as.vc.refreshService(name, &as.vc.serviceMap); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	as.writeStatus(w, name)
+}
+
+func (as *AdminServer) subscribe(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("service")
+	if err := as.vc.Subscribe(name); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	as.writeStatus(w, name)
+}
+
+func (as *AdminServer) unsubscribe(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("service")
+	if err := as.vc.Unsubscribe(name); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	as.writeStatus(w, name)
+}
+
+func (as *AdminServer) refresh(w http.ResponseWriter, r *http.Request) {
+	if err := as.vc.getAllServiceNames(); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	as.listServices(w, r)
+}
+
+func (as *AdminServer) flush(w http.ResponseWriter, r *http.Request) {
+	answers := as.vc.dnsCache.Count()
+	as.vc.removeDNSCache(func(DnsCache) bool { return true })
+
+	services := 0
+	if r.URL.Query().Get("services") == "true" {
+		// refetched from Nacos on the next query
+		for _, name := range as.vc.serviceMap.Keys() {
+			as.vc.serviceMap.Remove(name)
+			services++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"answers": answers, "services": services})
+}
+
+func (as *AdminServer) writeStatus(w http.ResponseWriter, name string) {
+	status := as.status(name)
+	if !status.Registered && !status.Cached && !status.Subscribed {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown service " + name})
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (as *AdminServer) status(name string) ServiceStatus {
+	status := ServiceStatus{
+		Name:       name,
+		Registered: as.vc.Registered(name),
+		Subscribed: as.vc.Subscribed(name),
+	}
+	if item, ok := as.vc.serviceMap.Get(name); ok {
+		if service, ok := item.(model.Service); ok {
+			status.Cached = true
+			status.Instances = len(service.Hosts)
+			status.Service = &service
+		}
+	}
+	if millis, ok := as.vc.syncMillis.Get(name); ok {
+		lastSync := time.UnixMilli(millis.(int64))
+		status.LastSync = &lastSync
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
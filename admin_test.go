@@ -0,0 +1,120 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, token string, v interface{}) int {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	if v != nil {
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), v), w.Body.String())
+	}
+	return w.Code
+}
+
+func TestAdminServer(t *testing.T) {
+	vc := NewNacosClientTEST()
+	backend := vc.naming().(*fakeBackend)
+	handler := NewAdminServer("127.0.0.1:0", "secret", vc).handler()
+
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(t, handler, "GET", "/services", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(t, handler, "GET", "/services", "guess", nil))
+
+	var statuses []ServiceStatus
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "POST", "/refresh", "secret", &statuses))
+	if assert.Len(t, statuses, 2) {
+		assert.Equal(t, "DEFAULT_GROUP@@demo.go", statuses[0].Name)
+		assert.True(t, statuses[0].Registered)
+		assert.False(t, statuses[0].Cached)
+		assert.Equal(t, "PAYMENT_GROUP@@orders", statuses[1].Name)
+	}
+
+	var status ServiceStatus
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, handler, "GET", "/services/DEFAULT_GROUP@@unknown", "secret", nil))
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "POST", "/services/DEFAULT_GROUP@@demo.go/refresh", "secret", &status))
+	assert.True(t, status.Cached)
+	assert.Equal(t, 2, status.Instances)
+	assert.NotNil(t, status.LastSync)
+	if assert.NotNil(t, status.Service) {
+		assert.Equal(t, "10.10.10.10", status.Service.Hosts[0].Ip)
+	}
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "POST", "/services/DEFAULT_GROUP@@demo.go/subscribe", "secret", &status))
+	assert.True(t, status.Subscribed)
+	assert.True(t, backend.subscribed("DEFAULT_GROUP@@demo.go"))
+
+	// pushes show up in the dump
+	backend.SetService(testService("demo.go", "10.0.0.9"))
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "GET", "/services/DEFAULT_GROUP@@demo.go", "secret", &status))
+	assert.Equal(t, 1, status.Instances)
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "POST", "/services/DEFAULT_GROUP@@demo.go/unsubscribe", "secret", &status))
+	assert.False(t, status.Subscribed)
+	assert.False(t, backend.subscribed("DEFAULT_GROUP@@demo.go"))
+
+	backend.SetDown(true)
+	assert.Equal(t, http.StatusBadGateway, adminRequest(t, handler, "POST", "/services/DEFAULT_GROUP@@demo.go/refresh", "secret", nil))
+	assert.Equal(t, http.StatusBadGateway, adminRequest(t, handler, "POST", "/refresh", "secret", nil))
+	backend.SetDown(false)
+
+	vc.dnsCache.Set("orders.svc.local./1/", DnsCache{Service: "DEFAULT_GROUP@@demo.go"})
+	var flushed map[string]int
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "POST", "/cache/flush", "secret", &flushed))
+	assert.Equal(t, map[string]int{"answers": 1, "services": 0}, flushed)
+	assert.Equal(t, 1, vc.serviceMap.Count())
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "POST", "/cache/flush?services=true", "secret", &flushed))
+	assert.Equal(t, map[string]int{"answers": 0, "services": 1}, flushed)
+	assert.Equal(t, 0, vc.serviceMap.Count())
+
+	r := httptest.NewRequest("GET", "/refresh", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestAdminServer_StartStop(t *testing.T) {
+	as := NewAdminServer("127.0.0.1:0", "secret", NewNacosClientTEST())
+	assert.NoError(t, as.Start())
+	assert.NoError(t, as.Start())
+	addr := as.ln.Addr().String()
+
+	r, _ := http.NewRequest("GET", "http://"+addr+"/services", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(r)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// a reload stops the listener before the new instance starts its own
+	assert.NoError(t, as.Stop())
+	assert.NoError(t, as.Stop())
+	as.Addr = addr
+	assert.NoError(t, as.Start())
+	assert.NoError(t, as.Stop())
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+)
+
+// Load balancing policies choose which instances, and in which order, answer
+// an A or AAAA query.
+const (
+	// PolicyAll answers every instance in registration order.
+	PolicyAll = "all"
+	// PolicyWeightedRandom shuffles the instances, the heavier an instance
+	// the more often it comes first.
+	PolicyWeightedRandom = "weighted_random"
+	// PolicyRoundRobin rotates the instances by one on every query.
+	PolicyRoundRobin = "round_robin"
+	// PolicyWeightedRoundRobin leads with the instances in proportion to
+	// their weights, smoothly interleaved like nginx does.
+	PolicyWeightedRoundRobin = "weighted_round_robin"
+)
+
+// Balancer orders the instances of the answers according to a policy and
+// keeps the first MaxAnswers of them. A nil Balancer answers every instance.
+type Balancer struct {
+	Policy     string
+	MaxAnswers int // 0 answers every instance
+
+	lock    sync.Mutex
+	offsets map[string]int                // round_robin position per answer
+	current map[string]map[string]float64 // weighted_round_robin state per answer
+	used    map[string]time.Time          // last query per answer, idle state is dropped
+	pruned  time.Time
+}
+
+// balancerIdle is how long the state of an answer outlives its last query.
+const balancerIdle = 10 * time.Minute
+
+func NewBalancer(policy string, maxAnswers int) *Balancer {
+	return &Balancer{
+		Policy:     policy,
+		MaxAnswers: maxAnswers,
+		offsets:    make(map[string]int),
+		current:    make(map[string]map[string]float64),
+		used:       make(map[string]time.Time),
+		pruned:     time.Now(),
+	}
+}
+
+// Stable reports whether every query gets the same answer, which can then be
+// cached.
+func (b *Balancer) Stable() bool {
+	return b == nil || b.Policy == PolicyAll || b.Policy == ""
+}
+
+// Select returns the instances answering key, see serviceQuery.balanceKey, in
+// the order of the policy and at most MaxAnswers of them.
+func (b *Balancer) Select(key string, hosts []model.Instance) []model.Instance {
+	if b == nil || len(hosts) == 0 {
+		return hosts
+	}
+
+	switch b.Policy {
+	case PolicyWeightedRandom:
+		hosts = weightedShuffle(hosts)
+	case PolicyRoundRobin:
+		hosts = rotate(hosts, b.next(key, len(hosts)))
+	case PolicyWeightedRoundRobin:
+		hosts = rotate(hosts, b.smooth(key, hosts))
+	}
+
+	if b.MaxAnswers > 0 && len(hosts) > b.MaxAnswers {
+		hosts = hosts[:b.MaxAnswers]
+	}
+	return hosts
+}
+
+func (b *Balancer) next(key string, n int) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.touch(key)
+	offset := b.offsets[key] % n
+	b.offsets[key] = offset + 1
+	return offset
+}
+
+// smooth picks the leading instance by smooth weighted round robin: every
+// instance gains its weight, the one with the most leads and pays back the
+// total. Instances gone since the last query are forgotten.
+func (b *Balancer) smooth(key string, hosts []model.Instance) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.touch(key)
+
+	last := b.current[key]
+	current := make(map[string]float64, len(hosts))
+	best, total := 0, 0.0
+	for i, host := range hosts {
+		id := instanceID(host)
+		current[id] = last[id] + host.Weight
+		total += host.Weight
+		if current[id] > current[instanceID(hosts[best])] {
+			best = i
+		}
+	}
+	current[instanceID(hosts[best])] -= total
+	b.current[key] = current
+	return best
+}
+
+// touch marks key as used and, at most every balancerIdle, drops the state of
+// the keys unused for longer. The caller holds the lock.
+func (b *Balancer) touch(key string) {
+	now := time.Now()
+	b.used[key] = now
+	if now.Sub(b.pruned) < balancerIdle {
+		return
+	}
+	for k, used := range b.used {
+		if now.Sub(used) >= balancerIdle {
+			delete(b.used, k)
+			delete(b.offsets, k)
+			delete(b.current, k)
+		}
+	}
+	b.pruned = now
+}
+
+// weightedShuffle orders hosts by weighted random sampling without
+// replacement (Efraimidis and Spirakis), the chance of a host to come first is
+// its share of the total weight.
+func weightedShuffle(hosts []model.Instance) []model.Instance {
+	keys := make([]float64, len(hosts))
+	order := make([]int, len(hosts))
+	for i, host := range hosts {
+		keys[i] = math.Pow(rand.Float64(), 1/host.Weight)
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return keys[order[i]] > keys[order[j]] })
+
+	result := make([]model.Instance, len(hosts))
+	for i, j := range order {
+		result[i] = hosts[j]
+	}
+	return result
+}
+
+// rotate returns hosts starting at the one at offset, followed by the others
+// in their order.
+func rotate(hosts []model.Instance, offset int) []model.Instance {
+	result := make([]model.Instance, 0, len(hosts))
+	result = append(result, hosts[offset:]...)
+	return append(result, hosts[:offset]...)
+}
+
+func instanceID(host model.Instance) string {
+	return net.JoinHostPort(host.Ip, strconv.FormatUint(host.Port, 10))
+}
+
+// addressHosts returns the hosts with an address of the family asked for by an
+// A or AAAA query.
+func addressHosts(hosts []model.Instance, qtype uint16) []model.Instance {
+	var result []model.Instance
+	for _, host := range hosts {
+		ip := net.ParseIP(host.Ip)
+		if ip == nil {
+			continue
+		}
+		if (ip.To4() != nil) == (qtype == dns.TypeA) {
+			result = append(result, host)
+		}
+	}
+	return result
+}
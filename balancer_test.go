@@ -0,0 +1,112 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func ips(hosts []model.Instance) []string {
+	var result []string
+	for _, host := range hosts {
+		result = append(result, host.Ip)
+	}
+	return result
+}
+
+func TestBalancer_Select(t *testing.T) {
+	hosts := testService("orders", "10.0.0.1", "10.0.0.2", "10.0.0.3").Hosts
+
+	var nilBalancer *Balancer
+	assert.Equal(t, hosts, nilBalancer.Select("orders", hosts))
+	assert.True(t, nilBalancer.Stable())
+
+	b := NewBalancer(PolicyAll, 2)
+	assert.True(t, b.Stable())
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, ips(b.Select("orders", hosts)))
+
+	b = NewBalancer(PolicyRoundRobin, 0)
+	assert.False(t, b.Stable())
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, ips(b.Select("orders", hosts)))
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.3", "10.0.0.1"}, ips(b.Select("orders", hosts)))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, ips(b.Select("billing", hosts[:2])))
+	assert.Equal(t, []string{"10.0.0.3", "10.0.0.1", "10.0.0.2"}, ips(b.Select("orders", hosts)))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, ips(b.Select("orders", hosts)))
+	// the original order is left alone
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, ips(hosts))
+}
+
+func TestBalancer_Weighted(t *testing.T) {
+	canary := testService("orders", "10.0.0.1", "10.0.0.2").Hosts
+	canary[0].Weight, canary[1].Weight = 9, 1
+
+	// smooth weighted round robin leads with the canary once every 10 queries
+	b := NewBalancer(PolicyWeightedRoundRobin, 1)
+	leads := map[string]int{}
+	for i := 0; i < 100; i++ {
+		answer := b.Select("orders", canary)
+		if assert.Len(t, answer, 1) {
+			leads[answer[0].Ip]++
+		}
+	}
+	assert.Equal(t, map[string]int{"10.0.0.1": 90, "10.0.0.2": 10}, leads)
+
+	b = NewBalancer(PolicyWeightedRandom, 0)
+	leads = map[string]int{}
+	for i := 0; i < 10000; i++ {
+		answer := b.Select("orders", canary)
+		if assert.Len(t, answer, 2) {
+			leads[answer[0].Ip]++
+		}
+	}
+	assert.InDelta(t, 9000, leads["10.0.0.1"], 300)
+	assert.InDelta(t, 1000, leads["10.0.0.2"], 300)
+
+	// a weight change applies to the next query
+	canary[1].Weight = 9
+	b = NewBalancer(PolicyWeightedRoundRobin, 1)
+	leads = map[string]int{}
+	for i := 0; i < 10; i++ {
+		leads[b.Select("orders", canary)[0].Ip]++
+	}
+	assert.Equal(t, map[string]int{"10.0.0.1": 5, "10.0.0.2": 5}, leads)
+}
+
+func TestBalancer_Prune(t *testing.T) {
+	hosts := testService("orders", "10.0.0.1", "10.0.0.2").Hosts
+	b := NewBalancer(PolicyRoundRobin, 0)
+	b.Select("orders", hosts)
+	b.Select("billing", hosts)
+
+	// billing is idle, orders still queried
+	b.used["billing"] = time.Now().Add(-balancerIdle)
+	b.pruned = time.Now().Add(-balancerIdle)
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.1"}, ips(b.Select("orders", hosts)))
+	assert.Equal(t, map[string]int{"orders": 2}, b.offsets)
+	assert.Len(t, b.used, 1)
+
+	// and starts over when queried again
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, ips(b.Select("billing", hosts)))
+}
+
+func TestAddressHosts(t *testing.T) {
+	hosts := testService("orders", "10.0.0.1", "fd00::1", "invalid", "10.0.0.2").Hosts
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, ips(addressHosts(hosts, dns.TypeA)))
+	assert.Equal(t, []string{"fd00::1"}, ips(addressHosts(hosts, dns.TypeAAAA)))
+}
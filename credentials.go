@@ -0,0 +1,109 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+)
+
+// loadCredentials reads the password and the secret key from their files.
+func (config *NacosClientConfig) loadCredentials() error {
+	if config.PasswordFile != "" {
+		password, err := readSecret(config.PasswordFile)
+		if err != nil {
+			return err
+		}
+		config.Password = password
+	}
+	if config.SecretKeyFile != "" {
+		secretKey, err := readSecret(config.SecretKeyFile)
+		if err != nil {
+			return err
+		}
+		config.SecretKey = secretKey
+	}
+	return nil
+}
+
+func readSecret(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (vc *NacosClient) asyncReloadCredentials(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+		vc.reloadCredentials()
+	}
+}
+
+// reloadCredentials reconnects to Nacos when the password or secret key file
+// changed, since the SDK only reads credentials when it is created. The
+// subscriptions move to the new backend, vc.config is left as configured since
+// queries read it concurrently.
+func (vc *NacosClient) reloadCredentials() bool {
+	config := vc.config
+	if err := config.loadCredentials(); err != nil {
+		log.Warningf("Failed to read nacos credentials, keeping the current ones: %s", err)
+		return false
+	}
+	vc.backendLock.RLock()
+	unchanged := config.Password == vc.password && config.SecretKey == vc.secretKey
+	vc.backendLock.RUnlock()
+	if unchanged {
+		return false
+	}
+
+	backend, err := newBackend(config)
+	if err != nil {
+		log.Errorf("Failed to reconnect to nacos with the new credentials: %s", err)
+		backend.Close()
+		return false
+	}
+	vc.backendLock.Lock()
+	old := vc.backend
+	vc.backend = backend
+	vc.password, vc.secretKey = config.Password, config.SecretKey
+	vc.backendLock.Unlock()
+
+	vc.subscribed.DLock.RLock()
+	var subscribed []string
+	for serviceKey := range vc.subscribed.Data {
+		subscribed = append(subscribed, serviceKey)
+	}
+	vc.subscribed.DLock.RUnlock()
+
+	for _, serviceKey := range subscribed {
+		if err := backend.Subscribe(serviceKey, vc.onPush); err != nil {
+			// subscribed again by the next query
+			vc.subscribed.DLock.Lock()
+			delete(vc.subscribed.Data, serviceKey)
+			vc.subscribed.DLock.Unlock()
+		}
+	}
+	old.Close()
+
+	log.Info("Nacos credentials changed, reconnected")
+	return true
+}
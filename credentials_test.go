@@ -0,0 +1,57 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNacosClient_reloadCredentials(t *testing.T) {
+	server := newFakeNacosServer(testService("orders", "10.0.0.1"))
+	defer server.Close()
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	assert.NoError(t, os.WriteFile(passwordFile, []byte("expired\n"), 0600))
+
+	config := NacosClientConfig{ServerHosts: []string{server.host()}, Protocol: ProtocolHttp, Username: "nacos", PasswordFile: passwordFile}
+	assert.NoError(t, config.loadCredentials())
+	assert.Equal(t, "expired", config.Password)
+	backend, _ := newBackend(config)
+	vc := newNacosClient(config, backend)
+	defer vc.Stop()
+
+	assert.NoError(t, vc.Subscribe("DEFAULT_GROUP@@orders"))
+	_, err := vc.naming().GetService("DEFAULT_GROUP@@orders")
+	assert.Error(t, err)
+	assert.False(t, vc.reloadCredentials())
+
+	// the rotated password reconnects and keeps the subscriptions
+	assert.NoError(t, os.WriteFile(passwordFile, []byte("secret\n"), 0600))
+	assert.True(t, vc.reloadCredentials())
+	service, err := vc.naming().GetService("DEFAULT_GROUP@@orders")
+	assert.NoError(t, err)
+	assert.Len(t, service.Hosts, 1)
+	assert.True(t, vc.Subscribed("DEFAULT_GROUP@@orders"))
+	assert.NotNil(t, vc.naming().(*NacosHttpClient).pushes["DEFAULT_GROUP@@orders"])
+
+	// an unreadable file keeps the current password
+	assert.NoError(t, os.Remove(passwordFile))
+	assert.False(t, vc.reloadCredentials())
+	assert.Equal(t, "secret", vc.password)
+	// the configuration read by queries is never replaced
+	assert.Equal(t, "expired", vc.config.Password)
+}
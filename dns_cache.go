@@ -14,16 +14,84 @@
 package nacos
 
 import (
+	"strconv"
+	"strings"
+
 	"github.com/miekg/dns"
-	"time"
 )
 
+// DnsCache is a response built for a service, kept packed until it expires or
+// the service changes.
 type DnsCache struct {
-	Msg             *dns.Msg
+	Msg             []byte
+	Service         string // group qualified name of the service answered
+	TTL             uint32 // the smallest TTL in Msg
 	LastUpdateMills int64
 }
 
+// DnsCacheKey returns the key of the response to a question. subnet scopes
+// answers which depend on the address of the client.
+func DnsCacheKey(qname string, qtype uint16, subnet string) string {
+	return strings.ToLower(qname) + "/" + strconv.Itoa(int(qtype)) + "/" + subnet
+}
+
+// NewDnsCache packs m, the answer for service. It returns false if m must not
+// be cached because a record in it has a zero TTL.
+func NewDnsCache(m *dns.Msg, service string) (DnsCache, bool) {
+	ttl, ok := minTTL(m)
+	if !ok || ttl == 0 {
+		return DnsCache{}, false
+	}
+
+	packed, err := m.Pack()
+	if err != nil {
+		return DnsCache{}, false
+	}
+
+	return DnsCache{Msg: packed, Service: service, TTL: ttl, LastUpdateMills: CurrentMillis()}, true
+}
+
+func minTTL(m *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl, found = rr.Header().Ttl, true
+			}
+		}
+	}
+	return ttl, found
+}
+
 func (dnsCache *DnsCache) Updated() bool {
-	updated := (int)(time.Now().UnixNano()/1000000-dnsCache.LastUpdateMills) < (int)(DNSTTL*1000)
-	return updated
+	return CurrentMillis()-dnsCache.LastUpdateMills < int64(dnsCache.TTL)*1000
+}
+
+// Reply unpacks the cached response as a reply to r, with TTLs reduced by the
+// age of the entry.
+func (dnsCache *DnsCache) Reply(r *dns.Msg) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(dnsCache.Msg); err != nil {
+		return nil, err
+	}
+
+	rcode := m.Rcode
+	m.SetReply(r)
+	m.Rcode = rcode
+
+	age := uint32((CurrentMillis() - dnsCache.LastUpdateMills) / 1000)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Ttl > age {
+				rr.Header().Ttl -= age
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return m, nil
 }
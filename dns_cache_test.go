@@ -14,21 +14,60 @@
 package nacos
 
 import (
-	"github.com/miekg/dns"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestDnsCache_Updated(t *testing.T) {
-	dnsCache := DnsCache{&dns.Msg{}, int64(100000)}
+	dnsCache := DnsCache{TTL: 1, LastUpdateMills: int64(100000)}
 
 	if !dnsCache.Updated() {
 		t.Log("Out of date test is passed")
 	}
 
-	dnsCache = DnsCache{&dns.Msg{}, int64(time.Now().UnixNano())}
+	dnsCache = DnsCache{TTL: 1, LastUpdateMills: time.Now().UnixNano() / 1e6}
 
 	if dnsCache.Updated() {
 		t.Log("Updated is passed.")
 	}
 }
+
+func TestDnsCache_Reply(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("orders.svc.local.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "orders.svc.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}},
+		&dns.A{Hdr: dns.RR_Header{Name: "orders.svc.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10}},
+	}
+
+	dnsCache, ok := NewDnsCache(m, "DEFAULT_GROUP@@orders")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(10), dnsCache.TTL)
+	assert.True(t, dnsCache.Updated())
+
+	// pretend the entry was cached 4 seconds ago
+	dnsCache.LastUpdateMills -= 4000
+	r.Id = 4242
+	r.Question[0].Name = "ORDERS.svc.local."
+	reply, err := dnsCache.Reply(r)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(4242), reply.Id)
+	assert.Equal(t, "ORDERS.svc.local.", reply.Question[0].Name)
+	assert.True(t, reply.Authoritative)
+	if assert.Len(t, reply.Answer, 2) {
+		assert.Equal(t, uint32(26), reply.Answer[0].Header().Ttl)
+		assert.Equal(t, uint32(6), reply.Answer[1].Header().Ttl)
+	}
+
+	m.Answer[0].Header().Ttl = 0
+	_, ok = NewDnsCache(m, "DEFAULT_GROUP@@orders")
+	assert.False(t, ok)
+
+	assert.Equal(t, DnsCacheKey("orders.svc.local.", dns.TypeA, ""), DnsCacheKey("ORDERS.svc.local.", dns.TypeA, ""))
+}
@@ -17,11 +17,6 @@ import (
 	"sync"
 )
 
-var domCache = DomCache{}
-var AllDoms AllDomsMap
-var indexMap = NewConcurrentMap()
-var serverManger = ServerManager{}
-
 type AllDomsMap struct {
 	Data         map[string]bool
 	CacheSeconds int
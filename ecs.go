@@ -0,0 +1,95 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// clientSubnet returns the EDNS Client Subnet option (RFC 7871) of r, nil if
+// it has none.
+func clientSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// subnetIP returns the address of the client subnet with the bits beyond the
+// source prefix cleared, nil if the subnet is invalid or a /0, which asks not
+// to take the client address into account.
+func subnetIP(ecs *dns.EDNS0_SUBNET) net.IP {
+	bits := 32
+	if ecs.Family == 2 {
+		bits = 128
+	} else if ecs.Family != 1 {
+		return nil
+	}
+	if ecs.SourceNetmask == 0 || int(ecs.SourceNetmask) > bits || ecs.Address == nil {
+		return nil
+	}
+	return ecs.Address.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits))
+}
+
+// subnetScope returns the client subnet of the query as the effective client
+// address, and the scope prefix length of the answers: 0 when they do not
+// depend on the client, else the source prefix or, when longer, the prefix of
+// the site network holding the subnet, which the answers are only valid for.
+func (vs *Nacos) subnetScope(ecs *dns.EDNS0_SUBNET) (clientIP string, scope uint8) {
+	ip := subnetIP(ecs)
+	if ip == nil {
+		return "", 0
+	}
+	if len(vs.Sites) == 0 {
+		return ip.String(), 0
+	}
+	scope = ecs.SourceNetmask
+	if _, prefix := vs.Sites.LookupPrefix(ip.String()); prefix > int(scope) {
+		scope = uint8(prefix)
+	}
+	return ip.String(), scope
+}
+
+// scopedSubnet is the subnet answers with the given scope are valid for, e.g.
+// 10.0.0.0/24.
+func scopedSubnet(ip string, scope uint8) string {
+	if scope == 0 {
+		return ""
+	}
+	return ip + "/" + strconv.Itoa(int(scope))
+}
+
+// setClientSubnet answers the client subnet option of the query with scope,
+// in an OPT record which carries nothing else.
+func setClientSubnet(m *dns.Msg, ecs *dns.EDNS0_SUBNET, scope uint8) {
+	opt := new(dns.OPT)
+	opt.Hdr.Name, opt.Hdr.Rrtype = ".", dns.TypeOPT
+	opt.Option = []dns.EDNS0{&dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        ecs.Family,
+		SourceNetmask: ecs.SourceNetmask,
+		SourceScope:   scope,
+		Address:       ecs.Address,
+	}}
+	m.Extra = append(m.Extra, opt)
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubnetIP(t *testing.T) {
+	tests := []struct {
+		family   uint16
+		netmask  uint8
+		address  string
+		expected string
+	}{
+		{1, 24, "10.240.5.7", "10.240.5.0"},
+		{1, 32, "10.240.5.7", "10.240.5.7"},
+		{2, 56, "fd00:1:2:3::1", "fd00:1:2::"},
+		{1, 0, "10.240.5.7", "<nil>"},
+		{1, 33, "10.240.5.7", "<nil>"},
+		{3, 24, "10.240.5.7", "<nil>"},
+	}
+
+	for _, test := range tests {
+		ecs := &dns.EDNS0_SUBNET{Family: test.family, SourceNetmask: test.netmask, Address: net.ParseIP(test.address)}
+		assert.Equal(t, test.expected, subnetIP(ecs).String(), "%s/%d", test.address, test.netmask)
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("orders.svc.local.", dns.TypeA)
+	assert.Nil(t, clientSubnet(r))
+
+	r.SetEdns0(4096, false)
+	assert.Nil(t, clientSubnet(r))
+
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("10.240.5.0")}
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "24a5ac1223c4b1d3"}, ecs)
+	assert.Equal(t, ecs, clientSubnet(r))
+}
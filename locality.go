@@ -0,0 +1,89 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"net"
+	"strings"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+)
+
+// SiteMetadataKeys are the instance metadata naming the site of an instance,
+// the first one set wins.
+var SiteMetadataKeys = []string{"site", "zone", "unit"}
+
+// Site maps client networks to the name of a site.
+type Site struct {
+	Name     string
+	Networks []*net.IPNet
+}
+
+// Sites are the sites of the clients, configured with site NAME CIDR...
+type Sites []Site
+
+// Lookup returns the site of the most specific network holding ip, "" if none
+// does.
+func (sites Sites) Lookup(ip string) string {
+	name, _ := sites.LookupPrefix(ip)
+	return name
+}
+
+// LookupPrefix is Lookup returning the prefix length of the network as well,
+// -1 if no network holds ip.
+func (sites Sites) LookupPrefix(ip string) (name string, prefix int) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", -1
+	}
+
+	name, longest := "", -1
+	for _, site := range sites {
+		for _, network := range site.Networks {
+			if ones, _ := network.Mask.Size(); network.Contains(addr) && ones > longest {
+				name, longest = site.Name, ones
+			}
+		}
+	}
+	return name, longest
+}
+
+// instanceSite returns the site an instance runs in according to its
+// metadata.
+func instanceSite(host model.Instance) string {
+	for _, key := range SiteMetadataKeys {
+		if site := host.Metadata[key]; site != "" {
+			return site
+		}
+	}
+	return ""
+}
+
+// local returns the hosts in site, or all hosts when none is.
+func local(hosts []model.Instance, site string) []model.Instance {
+	if site == "" {
+		return hosts
+	}
+
+	var result []model.Instance
+	for _, host := range hosts {
+		if strings.EqualFold(instanceSite(host), site) {
+			result = append(result, host)
+		}
+	}
+	if len(result) == 0 {
+		return hosts
+	}
+	return result
+}
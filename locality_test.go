@@ -0,0 +1,83 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSites(t *testing.T, sites map[string][]string) Sites {
+	var result Sites
+	for name, cidrs := range sites {
+		site := Site{Name: name}
+		for _, cidr := range cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			site.Networks = append(site.Networks, network)
+		}
+		result = append(result, site)
+	}
+	return result
+}
+
+func TestSites_Lookup(t *testing.T) {
+	sites := testSites(t, map[string][]string{
+		"hz":     {"10.0.0.0/8", "fd00::/8"},
+		"hz-lab": {"10.240.0.0/16"},
+		"sh":     {"192.168.0.0/16"},
+	})
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"10.1.2.3", "hz"},
+		{"10.240.0.1", "hz-lab"},
+		{"192.168.1.1", "sh"},
+		{"fd00::1", "hz"},
+		{"172.16.0.1", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, sites.Lookup(test.ip), test.ip)
+	}
+
+	name, prefix := sites.LookupPrefix("10.240.0.1")
+	assert.Equal(t, "hz-lab", name)
+	assert.Equal(t, 16, prefix)
+	_, prefix = sites.LookupPrefix("172.16.0.1")
+	assert.Equal(t, -1, prefix)
+
+	var none Sites
+	assert.Equal(t, "", none.Lookup("10.1.2.3"))
+}
+
+func TestLocal(t *testing.T) {
+	hosts := testService("orders", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4").Hosts
+	hosts[0].Metadata = map[string]string{"site": "hz"}
+	hosts[1].Metadata = map[string]string{"zone": "HZ"}
+	hosts[2].Metadata = map[string]string{"unit": "sh"}
+
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, ips(local(hosts, "hz")))
+	assert.Equal(t, []string{"10.0.0.3"}, ips(local(hosts, "sh")))
+	// other sites answer when the site has no instance
+	assert.Len(t, local(hosts, "bj"), 4)
+	assert.Len(t, local(hosts, ""), 4)
+}
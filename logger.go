@@ -0,0 +1,105 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	golog "log"
+	"sync/atomic"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// Levels of the log_level property, the plugin and the Nacos SDK log at the
+// level and above. They are the level names of the SDK.
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+var logLevels = map[string]int32{LevelDebug: 0, LevelInfo: 1, LevelWarn: 2, LevelError: 3}
+
+// log is the logger of the plugin, and of the Nacos SDK through sdkLogger.
+var log = &logger{P: clog.NewWithPlugin("nacos"), level: logLevels[LevelInfo]}
+
+// logger drops the clog messages below its level. The level is shared by
+// every nacos block, as the SDK logger is global too.
+type logger struct {
+	clog.P
+	level int32
+}
+
+func setLogLevel(level string) {
+	atomic.StoreInt32(&log.level, logLevels[level])
+}
+
+func (l *logger) enabled(level string) bool {
+	return atomic.LoadInt32(&l.level) <= logLevels[level]
+}
+
+// Debugf logs at debug level, either with log_level debug or the debug plugin
+// enabled.
+func (l *logger) Debugf(format string, v ...interface{}) {
+	if !l.enabled(LevelDebug) {
+		l.P.Debugf(format, v...)
+		return
+	}
+	// clog only prints debug messages with the debug plugin
+	golog.Printf("[DEBUG] plugin/nacos: "+format, v...)
+}
+
+func (l *logger) Debug(v ...interface{}) {
+	if !l.enabled(LevelDebug) {
+		l.P.Debug(v...)
+		return
+	}
+	golog.Print(append([]interface{}{"[DEBUG] plugin/nacos: "}, v...)...)
+}
+
+func (l *logger) Info(v ...interface{}) {
+	if l.enabled(LevelInfo) {
+		l.P.Info(v...)
+	}
+}
+
+func (l *logger) Infof(format string, v ...interface{}) {
+	if l.enabled(LevelInfo) {
+		l.P.Infof(format, v...)
+	}
+}
+
+func (l *logger) Warning(v ...interface{}) {
+	if l.enabled(LevelWarn) {
+		l.P.Warning(v...)
+	}
+}
+
+func (l *logger) Warningf(format string, v ...interface{}) {
+	if l.enabled(LevelWarn) {
+		l.P.Warningf(format, v...)
+	}
+}
+
+// sdkLogger hands the logs of the Nacos SDK to log.
+type sdkLogger struct{}
+
+func (sdkLogger) Info(args ...interface{})               { log.Info(args...) }
+func (sdkLogger) Warn(args ...interface{})               { log.Warning(args...) }
+func (sdkLogger) Error(args ...interface{})              { log.Error(args...) }
+func (sdkLogger) Debug(args ...interface{})              { log.Debug(args...) }
+func (sdkLogger) Infof(fmt string, args ...interface{})  { log.Infof(fmt, args...) }
+func (sdkLogger) Warnf(fmt string, args ...interface{})  { log.Warningf(fmt, args...) }
+func (sdkLogger) Errorf(fmt string, args ...interface{}) { log.Errorf(fmt, args...) }
+func (sdkLogger) Debugf(fmt string, args ...interface{}) { log.Debugf(fmt, args...) }
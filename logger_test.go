@@ -0,0 +1,61 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"bytes"
+	golog "log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger_Level(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+	defer setLogLevel(LevelInfo)
+
+	logAll := func() string {
+		buf.Reset()
+		log.Debugf("debug %d", 1)
+		log.Infof("info %d", 2)
+		log.Warningf("warning %d", 3)
+		log.Errorf("error %d", 4)
+		return buf.String()
+	}
+
+	out := logAll()
+	assert.NotContains(t, out, "debug 1")
+	assert.Contains(t, out, "[INFO] plugin/nacos: info 2")
+	assert.Contains(t, out, "[WARNING] plugin/nacos: warning 3")
+	assert.Contains(t, out, "[ERROR] plugin/nacos: error 4")
+
+	setLogLevel(LevelDebug)
+	assert.Contains(t, logAll(), "[DEBUG] plugin/nacos: debug 1")
+
+	setLogLevel(LevelWarn)
+	out = logAll()
+	assert.NotContains(t, out, "info 2")
+	assert.Contains(t, out, "warning 3")
+
+	// the SDK logs through the same levels
+	setLogLevel(LevelError)
+	buf.Reset()
+	sdkLogger{}.Warnf("sdk %s", "warning")
+	sdkLogger{}.Errorf("sdk %s", "error")
+	assert.NotContains(t, buf.String(), "sdk warning")
+	assert.Contains(t, buf.String(), "[ERROR] plugin/nacos: sdk error")
+}
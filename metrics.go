@@ -0,0 +1,175 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// requestCount counts the queries answered by the plugin, service is
+	// empty for names which are no Nacos service.
+	requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nacos",
+		Name:      "requests_total",
+		Help:      "Counter of queries answered, by service, query type and rcode.",
+	}, []string{"server", "service", "type", "rcode"})
+
+	// fallthroughCount counts the queries handed to the next plugin.
+	fallthroughCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nacos",
+		Name:      "fallthrough_total",
+		Help:      "Counter of queries in the zones of the plugin handed to the next plugin.",
+	}, []string{"server"})
+
+	// instancesReturned observes the instances answering a query of a service.
+	instancesReturned = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nacos",
+		Name:      "instances_returned",
+		Help:      "Histogram of the instances answering a query for a service.",
+		Buckets:   []float64{0, 1, 2, 3, 5, 10, 20, 50, 100},
+	}, []string{"server", "type"})
+
+	// protectThresholdCount counts the times a service, or its instances of
+	// the clusters asked for, entered protection and started to serve unhealthy
+	// instances because too few were healthy, see
+	// NacosClientConfig.ProtectThreshold. Queries while protected are not
+	// counted.
+	protectThresholdCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nacos",
+		Name:      "protect_threshold_reached_total",
+		Help:      "Counter of times a service entered protection, serving unhealthy instances because too few were healthy.",
+	}, []string{"service"})
+
+	// pushCount counts the changes of services pushed by Nacos.
+	pushCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nacos",
+		Name:      "pushes_total",
+		Help:      "Counter of service changes pushed by Nacos.",
+	}, []string{"service"})
+
+	// getServiceDuration observes the requests for a service to Nacos.
+	getServiceDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nacos",
+		Name:      "get_service_duration_seconds",
+		Help:      "Histogram of the time taken to get a service from Nacos.",
+		Buckets:   plugin.TimeBuckets,
+	}, []string{"namespace"})
+
+	// getServiceErrors counts the failed requests for a service to Nacos.
+	getServiceErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nacos",
+		Name:      "get_service_errors_total",
+		Help:      "Counter of failures to get a service from Nacos.",
+	}, []string{"service"})
+)
+
+// clientMetrics collects the state of the running clients when scraped.
+var clientMetrics = &clientCollector{clients: make(map[*NacosClient]struct{})}
+
+func init() {
+	prometheus.MustRegister(clientMetrics)
+}
+
+var (
+	servicesDesc = prometheus.NewDesc(prometheus.BuildFQName(plugin.Namespace, "nacos", "services_cached"),
+		"Number of distinct services cached by the clients of a namespace.", []string{"namespace"}, nil)
+	subscriptionsDesc = prometheus.NewDesc(prometheus.BuildFQName(plugin.Namespace, "nacos", "subscriptions"),
+		"Number of distinct services the clients of a namespace subscribed to.", []string{"namespace"}, nil)
+	syncAgeDesc = prometheus.NewDesc(prometheus.BuildFQName(plugin.Namespace, "nacos", "seconds_since_last_sync"),
+		"Seconds since a service was last fetched from or pushed by Nacos.", []string{"namespace", "service"}, nil)
+)
+
+// clientCollector reports the cache size, subscriptions and sync age of the
+// clients between their Start and Stop. Clients sharing a namespace, several
+// server blocks or the old and new client during a reload, are reported
+// together so that no series is collected twice.
+type clientCollector struct {
+	lock    sync.Mutex
+	clients map[*NacosClient]struct{}
+}
+
+func (cc *clientCollector) add(vc *NacosClient) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.clients[vc] = struct{}{}
+}
+
+func (cc *clientCollector) remove(vc *NacosClient) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	delete(cc.clients, vc)
+}
+
+func (cc *clientCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- servicesDesc
+	ch <- subscriptionsDesc
+	ch <- syncAgeDesc
+}
+
+// namespaceStats is the state of the clients of one namespace.
+type namespaceStats struct {
+	cached     map[string]bool
+	subscribed map[string]bool
+	synced     map[string]int64 // latest sync per service
+}
+
+func (cc *clientCollector) Collect(ch chan<- prometheus.Metric) {
+	cc.lock.Lock()
+	namespaces := map[string]*namespaceStats{}
+	for vc := range cc.clients {
+		stats := namespaces[vc.config.NamespaceId]
+		if stats == nil {
+			stats = &namespaceStats{cached: map[string]bool{}, subscribed: map[string]bool{}, synced: map[string]int64{}}
+			namespaces[vc.config.NamespaceId] = stats
+		}
+		for _, serviceKey := range vc.serviceMap.Keys() {
+			stats.cached[serviceKey] = true
+		}
+
+		vc.subscribed.DLock.RLock()
+		for serviceKey := range vc.subscribed.Data {
+			stats.subscribed[serviceKey] = true
+		}
+		vc.subscribed.DLock.RUnlock()
+
+		for serviceKey, millis := range vc.syncMillis.Items() {
+			if millis.(int64) > stats.synced[serviceKey] {
+				stats.synced[serviceKey] = millis.(int64)
+			}
+		}
+	}
+	cc.lock.Unlock()
+
+	now := CurrentMillis()
+	for namespace, stats := range namespaces {
+		ch <- prometheus.MustNewConstMetric(servicesDesc, prometheus.GaugeValue, float64(len(stats.cached)), namespace)
+		ch <- prometheus.MustNewConstMetric(subscriptionsDesc, prometheus.GaugeValue, float64(len(stats.subscribed)), namespace)
+		for serviceKey, millis := range stats.synced {
+			age := float64(now-millis) / 1000
+			ch <- prometheus.MustNewConstMetric(syncAgeDesc, prometheus.GaugeValue, age, namespace, serviceKey)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNacos_ServeDNSMetrics(t *testing.T) {
+	vs := newTestNacos([]string{"svc.local."}, testService("orders", "10.0.0.1", "10.0.0.2"), testService("empty"))
+	vs.DNSCache = vs.NacosClientImpl.GetDNSCache()
+	vs.Fall.SetZonesFromArgs(nil)
+
+	noerror := requestCount.WithLabelValues("", "DEFAULT_GROUP@@orders", "A", "NOERROR")
+	fallthroughs := fallthroughCount.WithLabelValues("")
+	requests, falls := testutil.ToFloat64(noerror), testutil.ToFloat64(fallthroughs)
+
+	serve(t, vs, "orders.svc.local.", dns.TypeA)
+	serve(t, vs, "orders.svc.local.", dns.TypeA) // from the cache
+	assert.Equal(t, requests+2, testutil.ToFloat64(noerror))
+
+	serve(t, vs, "unknown.svc.local.", dns.TypeA)
+	serve(t, vs, "empty.svc.local.", dns.TypeA)
+	assert.Equal(t, falls+2, testutil.ToFloat64(fallthroughs))
+
+	vs.Fall.SetZonesFromArgs([]string{"other.local."})
+	nxdomain := requestCount.WithLabelValues("", "", "A", "NXDOMAIN")
+	before := testutil.ToFloat64(nxdomain)
+	serve(t, vs, "unknown.svc.local.", dns.TypeA)
+	assert.Equal(t, before+1, testutil.ToFloat64(nxdomain))
+}
+
+func TestNacosClient_Metrics(t *testing.T) {
+	vc := NewNacosClientTEST()
+	pushes := pushCount.WithLabelValues("DEFAULT_GROUP@@demo.go")
+	errors := getServiceErrors.WithLabelValues("DEFAULT_GROUP@@demo.go")
+
+	failures := testutil.ToFloat64(errors)
+	vc.naming().(*fakeBackend).SetDown(true)
+	vc.getServiceNow("DEFAULT_GROUP@@demo.go", &vc.serviceMap, "")
+	assert.Equal(t, failures+1, testutil.ToFloat64(errors))
+	vc.naming().(*fakeBackend).SetDown(false)
+
+	vc.config.NamespaceId = "metrics"
+	vc.Start()
+	vc.getServiceNow("DEFAULT_GROUP@@demo.go", &vc.serviceMap, "")
+	vc.Subscribe("DEFAULT_GROUP@@demo.go")
+
+	before := testutil.ToFloat64(pushes)
+	vc.naming().(*fakeBackend).SetService(testService("demo.go", "10.0.0.9"))
+	assert.Equal(t, before+1, testutil.ToFloat64(pushes))
+
+	subscriptions := func() string {
+		var lines []string
+		for _, line := range strings.Split(collected(t, "coredns_nacos_subscriptions"), "\n") {
+			if strings.Contains(line, `namespace="metrics"`) {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+	assert.Equal(t, `coredns_nacos_subscriptions{namespace="metrics"} 1`, subscriptions())
+	assert.Contains(t, collected(t, "coredns_nacos_services_cached"), `coredns_nacos_services_cached{namespace="metrics"} 1`)
+	assert.Contains(t, collected(t, "coredns_nacos_seconds_since_last_sync"), `namespace="metrics",service="DEFAULT_GROUP@@demo.go"`)
+
+	vc.Stop()
+	assert.Empty(t, subscriptions())
+}
+
+// collected returns the text exposition of the metric of the running clients.
+func collected(t *testing.T, name string) string {
+	registry := prometheus.NewPedanticRegistry()
+	assert.NoError(t, registry.Register(clientMetrics))
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	var lines []string
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.Metric {
+			var labels []string
+			for _, label := range metric.Label {
+				labels = append(labels, label.GetName()+"="+strconv.Quote(label.GetValue()))
+			}
+			lines = append(lines, fmt.Sprintf("%s{%s} %v", name, strings.Join(labels, ","), metric.GetGauge().GetValue()))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestNacosClient_MetricsSharedNamespace(t *testing.T) {
+	// two server blocks, or the old and the new client of a reload
+	first := newNacosClient(NacosClientConfig{NamespaceId: "shared"}, newFakeBackend(testService("orders", "10.0.0.1")))
+	second := newNacosClient(NacosClientConfig{NamespaceId: "shared"}, newFakeBackend(testService("orders", "10.0.0.1"), testService("billing", "10.0.1.1")))
+	clientMetrics.add(first)
+	clientMetrics.add(second)
+	defer clientMetrics.remove(first)
+	defer clientMetrics.remove(second)
+
+	first.getServiceNow("DEFAULT_GROUP@@orders", &first.serviceMap, "")
+	assert.NoError(t, first.Subscribe("DEFAULT_GROUP@@orders"))
+	second.getServiceNow("DEFAULT_GROUP@@orders", &second.serviceMap, "")
+	second.getServiceNow("DEFAULT_GROUP@@billing", &second.serviceMap, "")
+	assert.NoError(t, second.Subscribe("DEFAULT_GROUP@@billing"))
+
+	assert.Contains(t, collected(t, "coredns_nacos_services_cached"), `coredns_nacos_services_cached{namespace="shared"} 2`)
+	assert.Contains(t, collected(t, "coredns_nacos_subscriptions"), `coredns_nacos_subscriptions{namespace="shared"} 2`)
+	assert.Equal(t, 2, strings.Count(collected(t, "coredns_nacos_seconds_since_last_sync"), `namespace="shared"`))
+}
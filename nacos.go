@@ -16,18 +16,49 @@ package nacos
 import (
 	"context"
 	"encoding/json"
+	"math"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/coredns/coredns/plugin/pkg/fall"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"github.com/nacos-group/nacos-sdk-go/v2/common/constant"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+)
+
+// Naming schemes map the labels in front of the zone to a Nacos service.
+const (
+	// SchemeService looks every name up in the default group.
+	SchemeService = "service"
+	// SchemeServiceGroup reads the last label as the group when it names one
+	// of the configured groups, so orders.payment_group.<zone> resolves the
+	// service orders of PAYMENT_GROUP.
+	SchemeServiceGroup = "service.group"
 )
 
 type Nacos struct {
 	Next            plugin.Handler
 	Zones           []string
+	Groups          []string // the first group is the default one
+	NamingScheme    string
+	Clusters        []string // clusters answered when the query names none
+	SOA             SOAConfig
+	TTL             uint32 // for services which do not set cacheMillis
+	MinTTL          uint32
+	MaxTTL          uint32 // 0 leaves TTLs unbounded
 	NacosClientImpl *NacosClient
 	DNSCache        ConcurrentMap
+	Fall            fall.F       // zones handing unknown and empty services to the next plugin
+	Balancer        *Balancer    // orders and limits the address records, nil answers them all
+	Sites           Sites        // client networks preferring the instances of their site
+	Admin           *AdminServer `json:"-"` // nil unless admin_listen is set
+
+	nonTerminals nonTerminals
 }
 
 func (vs *Nacos) String() string {
@@ -45,10 +76,7 @@ func (vs *Nacos) managed(service, clientIP string) bool {
 		return false
 	}
 
-	defer AllDoms.DLock.RUnlock()
-
-	AllDoms.DLock.RLock()
-	_, ok1 := AllDoms.Data[service]
+	ok1 := vs.NacosClientImpl.Registered(service)
 
 	_, inCache := vs.NacosClientImpl.GetDomainCache().Get(service)
 
@@ -57,78 +85,376 @@ func (vs *Nacos) managed(service, clientIP string) bool {
 		根据dns请求订阅服务：
 		1.服务首次请求, 缓存中没有数据
 		2.插件初始化时在缓存文件中缓存了该服务数据, 但未订阅
+		订阅在后台进行, 失败后退避, 查询不等待Nacos
 	*/
 	if ok1 {
 		if !inCache {
 			vs.NacosClientImpl.getServiceNow(service, &vs.NacosClientImpl.serviceMap, clientIP)
 		}
-		if !GrpcClient.HasSubcribed(service) {
-			GrpcClient.Subscribe(service)
-		}
+		vs.NacosClientImpl.asyncSubscribe(service)
 	}
 
 	return ok1 || inCache
 }
 
+// serviceName strips zone from qname and returns the remaining labels, which
+// name the Nacos service. It returns "" when qname is the zone apex.
+func serviceName(qname, zone string) string {
+	labels := dns.SplitDomainName(qname)
+	n := len(labels) - dns.CountLabel(zone)
+	if n <= 0 {
+		return ""
+	}
+	return strings.Join(labels[:n], ".")
+}
+
+// serviceKey maps the name of a service, as found in front of the zone, to
+// its group qualified key according to the naming scheme.
+func (vs *Nacos) serviceKey(name string) string {
+	group := vs.defaultGroup()
+
+	if vs.NamingScheme == SchemeServiceGroup {
+		if i := strings.LastIndex(name, "."); i > 0 {
+			for _, g := range vs.Groups {
+				// DNS is case insensitive, Nacos groups are not
+				if strings.EqualFold(g, name[i+1:]) {
+					return ServiceKey(name[:i], g)
+				}
+			}
+		}
+	}
+
+	return ServiceKey(name, group)
+}
+
+// defaultGroup is the group of names without a group label.
+func (vs *Nacos) defaultGroup() string {
+	if len(vs.Groups) > 0 {
+		return vs.Groups[0]
+	}
+	return constant.DEFAULT_GROUP
+}
+
+// serviceQuery is what the labels in front of the zone ask for.
+type serviceQuery struct {
+	key      string // group qualified service name, see ServiceKey
+	name     string // the labels naming the service
+	cluster  string // set by a <cluster>.<service> query
+	instance net.IP // set by a <instance>.<service> query, see instanceLabel
+	proto    string // set by a _<service>._<proto> query
+}
+
+// parseQuery resolves name to a service. A name which is not a service itself
+// is tried as <cluster>.<service>, for a cluster of the service, or
+// <instance>.<service>.
+func (vs *Nacos) parseQuery(name string) serviceQuery {
+	var query serviceQuery
+	if service, proto, ok := parseSRV(name); ok {
+		name, query.proto = service, proto
+	}
+
+	query.name, query.key = name, vs.serviceKey(name)
+	if vs.known(query.key) {
+		return query
+	}
+
+	if i := strings.Index(name, "."); i > 0 {
+		if key := vs.serviceKey(name[i+1:]); vs.known(key) {
+			query.name, query.key = name[i+1:], key
+			if ip := parseInstanceLabel(name[:i]); ip != nil {
+				query.instance = ip
+			} else if vs.hasCluster(key, name[:i]) {
+				query.cluster = name[:i]
+			} else {
+				// not a cluster, the name does not exist
+				query.name, query.key = name, vs.serviceKey(name)
+			}
+		}
+	}
+
+	return query
+}
+
+// dnsNames returns the names, in front of the zone, a service is found at
+// according to the naming scheme.
+func (vs *Nacos) dnsNames(key string) []string {
+	name, group := SplitServiceKey(key)
+	var names []string
+	if group == vs.defaultGroup() {
+		names = append(names, name)
+	}
+	if vs.NamingScheme == SchemeServiceGroup {
+		for _, g := range vs.Groups {
+			if g == group {
+				names = append(names, name+"."+g)
+			}
+		}
+	}
+	return names
+}
+
+// hasCluster reports whether cluster is one of the clusters directive or has
+// instances of the service.
+func (vs *Nacos) hasCluster(key, cluster string) bool {
+	for _, c := range vs.Clusters {
+		if strings.EqualFold(c, cluster) {
+			return true
+		}
+	}
+	for _, host := range vs.NacosClientImpl.GetService(key, "").Hosts {
+		if strings.EqualFold(host.ClusterName, cluster) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSRV splits an RFC 2782 _<service>._<proto>[.<rest>] name into the
+// name of the service, <service>[.<rest>], and the protocol.
+func parseSRV(name string) (service, proto string, ok bool) {
+	labels := strings.SplitN(name, ".", 3)
+	if len(labels) < 2 || len(labels[0]) < 2 || len(labels[1]) < 2 ||
+		labels[0][0] != '_' || labels[1][0] != '_' {
+		return "", "", false
+	}
+
+	service = labels[0][1:]
+	if len(labels) == 3 {
+		service += "." + labels[2]
+	}
+	return service, labels[1][1:], true
+}
+
+// instanceLabel is the DNS label naming a single instance of a service, its
+// address with dots or colons replaced by dashes, e.g. 10-0-0-1.
+func instanceLabel(ip string) string {
+	return strings.NewReplacer(".", "-", ":", "-").Replace(ip)
+}
+
+func parseInstanceLabel(label string) net.IP {
+	if ip := net.ParseIP(strings.ReplaceAll(label, "-", ".")); ip != nil {
+		return ip
+	}
+	return net.ParseIP(strings.ReplaceAll(label, "-", ":"))
+}
+
+// protocol is the transport an instance serves, tcp unless its "protocol"
+// metadata says otherwise.
+func protocol(host model.Instance) string {
+	if p := host.Metadata["protocol"]; p != "" {
+		return p
+	}
+	return "tcp"
+}
+
+// filter drops the hosts which are not the instance or do not serve the
+// protocol asked for.
+func (query serviceQuery) filter(hosts []model.Instance) []model.Instance {
+	if query.instance == nil && query.proto == "" {
+		return hosts
+	}
+
+	var result []model.Instance
+	for _, host := range hosts {
+		if query.instance != nil && !query.instance.Equal(net.ParseIP(host.Ip)) {
+			continue
+		}
+		if query.proto != "" && !strings.EqualFold(protocol(host), query.proto) {
+			continue
+		}
+		result = append(result, host)
+	}
+	return result
+}
+
+// balanceKey identifies the answers a Balancer rotates, those of the same
+// instances for the same site. Unlike the cache key it leaves out the client
+// subnet, which clients choose freely.
+func (query serviceQuery) balanceKey(qtype uint16, site string) string {
+	var instance string
+	if query.instance != nil {
+		instance = query.instance.String()
+	}
+	return strings.Join([]string{query.key, strings.ToLower(query.cluster), instance,
+		strings.ToLower(query.proto), strconv.Itoa(int(qtype)), site}, "/")
+}
+
+func (vs *Nacos) known(key string) bool {
+	_, inCache := vs.NacosClientImpl.GetDomainCache().Get(key)
+	return inCache || vs.NacosClientImpl.Registered(key)
+}
+
+// clusters returns the clusters whose instances answer query, nil meaning all.
+func (vs *Nacos) clusters(query serviceQuery) []string {
+	if query.cluster != "" {
+		return []string{query.cluster}
+	}
+	return vs.Clusters
+}
+
+// addressRecord returns an A or AAAA record for ip, nil if ip is invalid.
+func addressRecord(name, ip string, ttl uint32) dns.RR {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+	if addr.To4() != nil {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: addr.To4()}
+	}
+	return &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}, AAAA: addr}
+}
+
+// addressRecords returns the A records of the IPv4 hosts for an A query and
+// the AAAA records of the IPv6 hosts for an AAAA query.
+func addressRecords(state request.Request, hosts []model.Instance, ttl uint32) []dns.RR {
+	answer := make([]dns.RR, 0, len(hosts))
+	for _, host := range hosts {
+		rr := addressRecord(state.QName(), host.Ip, ttl)
+		if rr != nil && rr.Header().Rrtype == state.QType() {
+			answer = append(answer, rr)
+		}
+	}
+	return answer
+}
+
+// srvWeightScale keeps two decimals of Nacos weights, so a canary at 0.1 gets
+// a tenth of the share of an instance at 1.
+const srvWeightScale = 100
+
+// srvWeight converts a Nacos weight, a positive float, to an SRV weight in
+// 1..65535.
+func srvWeight(weight float64) uint16 {
+	return uint16(math.Max(1, math.Min(math.Round(weight*srvWeightScale), math.MaxUint16)))
+}
+
+// srvRecords returns one SRV record per host, targeting the host's own
+// <instance>.<service>.<zone> name, and the address records of those targets.
+func (vs *Nacos) srvRecords(state request.Request, query serviceQuery, zone string, hosts []model.Instance, ttl uint32) (answer, extra []dns.RR) {
+	for _, host := range hosts {
+		target := dnsutil.Join(instanceLabel(host.Ip), query.name, zone)
+		answer = append(answer, &dns.SRV{
+			Hdr:    dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeSRV, Class: state.QClass(), Ttl: ttl},
+			Weight: srvWeight(host.Weight),
+			Port:   uint16(host.Port),
+			Target: target,
+		})
+		if rr := addressRecord(target, host.Ip, ttl); rr != nil {
+			extra = append(extra, rr)
+		}
+	}
+	return answer, extra
+}
+
 func (vs *Nacos) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
 
 	name := state.QName()
 	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative, m.RecursionAvailable, m.Compress = true, true, true
+
+	zone := plugin.Zones(vs.Zones).Matches(name)
+	if zone == "" {
+		return plugin.NextOrFailure(vs.Name(), vs.Next, ctx, w, r)
+	}
 
+	server := metrics.WithServer(ctx)
 	clientIP := state.IP()
 	if clientIP == "127.0.0.1" {
 		clientIP = LocalIP()
 	}
+	// behind a resolver the client subnet stands for the client
+	ecs := clientSubnet(r)
+	var scope uint8
+	if ecs != nil {
+		clientIP, scope = vs.subnetScope(ecs)
+	}
+	site := vs.Sites.Lookup(clientIP)
 
-	if !vs.managed(name[:len(name)-1], clientIP) {
-		return plugin.NextOrFailure(vs.Name(), vs.Next, ctx, w, r)
-	} else {
-		//hosts := make([]model.Instance, 0)
-		hosts := vs.NacosClientImpl.SrvInstances(name[:len(name)-1], clientIP)
-		//hosts = append(hosts, *host)
-		answer := make([]dns.RR, 0)
-		extra := make([]dns.RR, 0)
-		for _, host := range hosts {
-			var rr dns.RR
-
-			switch state.Family() {
-			case 1:
-				rr = new(dns.A)
-				rr.(*dns.A).Hdr = dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeA, Class: state.QClass(), Ttl: DNSTTL}
-				rr.(*dns.A).A = net.ParseIP(host.Ip).To4()
-			case 2:
-				rr = new(dns.AAAA)
-				rr.(*dns.AAAA).Hdr = dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeAAAA, Class: state.QClass(), Ttl: DNSTTL}
-				rr.(*dns.AAAA).AAAA = net.ParseIP(host.Ip)
+	subnet := site
+	if scope > 0 {
+		subnet = scopedSubnet(clientIP, scope)
+	}
+	cacheKey := DnsCacheKey(name, state.QType(), subnet)
+	if vs.DNSCache != nil {
+		if item, ok := vs.DNSCache.Get(cacheKey); ok {
+			if entry := item.(DnsCache); entry.Updated() {
+				if cached, err := entry.Reply(r); err == nil {
+					requestCount.WithLabelValues(server, entry.Service, state.Type(), dns.RcodeToString[cached.Rcode]).Inc()
+					return vs.write(state, cached, ecs, scope)
+				}
 			}
+		}
+	}
 
-			srv := new(dns.SRV)
-			if host.Metadata == nil || host.Metadata["protocol"] == "" {
-				srv.Hdr = dns.RR_Header{Name: "_" + "tcp" + "." + state.QName(), Rrtype: dns.TypeSRV, Class: state.QClass(), Ttl: DNSTTL}
-			} else {
-				srv.Hdr = dns.RR_Header{Name: "_" + host.Metadata["protocol"] + "." + state.QName(), Rrtype: dns.TypeSRV, Class: state.QClass(), Ttl: DNSTTL}
-			}
-			port := host.Port
-			srv.Port = uint16(port)
-			srv.Target = state.QName()
-			srv.Weight = uint16(host.Weight)
-			extra = append(extra, srv)
-			answer = append(answer, rr)
+	var query serviceQuery
+	labels := serviceName(name, zone)
+	if labels != "" {
+		query = vs.parseQuery(labels)
+	}
+
+	service := "" // unknown names are not counted by name
+	switch {
+	case query.key == "" || !vs.managed(query.key, clientIP):
+		// the root zone serves services next to the rest of the DNS tree,
+		// everything else is ours to deny
+		if zone == "." || (query.key != "" && vs.Fall.Through(name)) {
+			fallthroughCount.WithLabelValues(server).Inc()
+			return plugin.NextOrFailure(vs.Name(), vs.Next, ctx, w, r)
+		}
+		// names above services exist without records of their own, RFC 8020
+		if query.key != "" && !vs.emptyNonTerminal(labels) {
+			m.Rcode = dns.RcodeNameError
+		} else if state.QType() == dns.TypeSOA {
+			m.Answer = []dns.RR{vs.soa(zone)}
 		}
+	default:
+		hosts := query.filter(vs.NacosClientImpl.SrvInstances(query.key, clientIP, vs.clusters(query)...))
+		if len(hosts) == 0 && vs.Fall.Through(name) {
+			fallthroughCount.WithLabelValues(server).Inc()
+			return plugin.NextOrFailure(vs.Name(), vs.Next, ctx, w, r)
+		}
+		ttl := vs.ttl(vs.NacosClientImpl.GetService(query.key, clientIP), vs.NacosClientImpl.ServiceMetadata(query.key), hosts)
 
-		m.Answer = answer
-		m.Extra = extra
-		result, _ := json.Marshal(m.Answer)
-		NacosClientLogger.Info("[RESOLVE]", " ["+name[:len(name)-1]+"]  result: "+string(result)+", clientIP: "+clientIP)
+		switch state.QType() {
+		case dns.TypeSRV:
+			m.Answer, m.Extra = vs.srvRecords(state, query, zone, local(hosts, site), ttl)
+		case dns.TypeA, dns.TypeAAAA:
+			hosts = vs.Balancer.Select(query.balanceKey(state.QType(), site), local(addressHosts(hosts, state.QType()), site))
+			m.Answer = addressRecords(state, hosts, ttl)
+		}
+		instancesReturned.WithLabelValues(server, state.Type()).Observe(float64(len(m.Answer)))
+		service = query.key
+
+		log.Debugf("Resolved %s for %s: %v", query.key, clientIP, m.Answer)
 	}
 
-	m.SetReply(r)
-	m.Authoritative, m.RecursionAvailable, m.Compress = true, true, true
+	// NXDOMAIN and NODATA carry the SOA for negative caching
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{vs.soa(zone)}
+	}
+
+	// only answers for services are cached, they are invalidated by updates.
+	// Address records balanced per query are not
+	balanced := state.QType() == dns.TypeA || state.QType() == dns.TypeAAAA
+	if vs.DNSCache != nil && m.Rcode == dns.RcodeSuccess && query.key != "" && (vs.Balancer.Stable() || !balanced) {
+		if entry, ok := NewDnsCache(m, query.key); ok {
+			vs.DNSCache.Set(cacheKey, entry)
+		}
+	}
 
+	requestCount.WithLabelValues(server, service, state.Type(), dns.RcodeToString[m.Rcode]).Inc()
+	return vs.write(state, m, ecs, scope)
+}
+
+// write answers the query with m, and its client subnet, if any, with scope.
+func (vs *Nacos) write(state request.Request, m *dns.Msg, ecs *dns.EDNS0_SUBNET, scope uint8) (int, error) {
+	if ecs != nil && m.IsEdns0() == nil {
+		setClientSubnet(m, ecs, scope)
+	}
 	state.SizeAndDo(m)
 	m = state.Scrub(m)
-	w.WriteMsg(m)
+	state.W.WriteMsg(m)
 	return dns.RcodeSuccess, nil
 }
 
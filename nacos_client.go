@@ -14,36 +14,125 @@
 package nacos
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/nacos-group/nacos-sdk-go/v2/common/constant"
 	"github.com/nacos-group/nacos-sdk-go/v2/model"
-
-	"github.com/cihub/seelog"
 )
 
-var (
-	NacosClientLogger seelog.LoggerInterface
-	LogConfig         string
-	GrpcClient        *NacosGrpcClient
-)
+// NacosClientConfig is where and how a NacosClient reaches Nacos. Every
+// client owns its settings, so that several nacos blocks, e.g. one per
+// namespace, can serve side by side.
+type NacosClientConfig struct {
+	NamespaceId string
+	ServerHosts []string
+	Username    string
+	Password    string
+	// PasswordFile and SecretKeyFile are re-read while running, see
+	// reloadCredentials.
+	PasswordFile  string
+	AccessKey     string
+	SecretKey     string
+	SecretKeyFile string
+	Groups        []string
+	Protocol      string // ProtocolGrpc by default, or ProtocolHttp for the v1 Open API
+	Scheme        string // http, or https when TLS is enabled, by default
+	ContextPath   string // /nacos by default
+	TLS           constant.TLSConfig
+	// ProtectThreshold is the ratio of healthy instances at or below which
+	// SrvInstances serves the unhealthy ones too, 0 disables it.
+	ProtectThreshold float64
+	HealthTimeout    time.Duration // not ready after this long without contact to Nacos, 0 never
+	CachePath        string        // nacos-go-client-cache in the home directory by default
+	LogLevel         string        // LevelInfo by default, applies to the Nacos SDK too
+}
+
+func (config NacosClientConfig) protocol() string {
+	if config.Protocol != "" {
+		return config.Protocol
+	}
+	return ProtocolGrpc
+}
 
-func init() {
-	initLog()
+func (config NacosClientConfig) logLevel() string {
+	if config.LogLevel == "" {
+		return LevelInfo
+	}
+	return config.LogLevel
+}
+
+func (config NacosClientConfig) scheme() string {
+	if config.Scheme != "" {
+		return config.Scheme
+	}
+	if config.TLS.Enable {
+		return "https"
+	}
+	return "http"
+}
+
+func (config NacosClientConfig) contextPath() string {
+	if config.ContextPath != "" {
+		return config.ContextPath
+	}
+	return "/nacos"
+}
+
+// tlsConfig verifies Nacos with the CA bundle, or the system roots, and
+// presents the client certificate if there is one.
+func (config NacosClientConfig) tlsConfig() (*tls.Config, error) {
+	var args []string
+	if config.TLS.CertFile != "" || config.TLS.KeyFile != "" {
+		args = append(args, config.TLS.CertFile, config.TLS.KeyFile)
+	}
+	if config.TLS.CaFile != "" {
+		args = append(args, config.TLS.CaFile)
+	}
+	tlsConfig, err := pkgtls.NewTLSConfigFromArgs(args...)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = config.TLS.ServerNameOverride
+	return tlsConfig, nil
 }
 
 type NacosClient struct {
-	serviceMap ConcurrentMap
-	udpServer  UDPServer
+	config         NacosClientConfig
+	cancel         context.CancelFunc //停止后台任务
+	workers        sync.WaitGroup
+	backend        NamingBackend //凭据变化时替换, 经naming()读取
+	backendLock    sync.RWMutex
+	password       string //backend使用的凭据, config创建后不再修改
+	secretKey      string
+	allDoms        AllDomsMap //服务端的全部服务
+	subscribed     AllDomsMap //已订阅推送的服务
+	subscribeLock  sync.Mutex
+	subscribing    map[string]int64 //后台订阅中(0)或最近一次订阅失败的时间
+	subscribers    sync.WaitGroup   //后台订阅, Stop时等待
+	stopped        bool             //已Stop, 不再后台订阅
+	serviceMap     ConcurrentMap
+	dnsCache       ConcurrentMap //已构造的DNS应答, 服务变化时失效
+	indexMap       ConcurrentMap //SrvInstance的轮询位置
+	syncMillis     ConcurrentMap //服务最近一次同步成功的时间
+	metadata       ConcurrentMap //服务自身的元数据, 实例列表不包含, 定期读取
+	protected      ConcurrentMap //达到保护阈值的服务及集群, 进入和离开时记录日志
+	contactMillis  int64         //最近一次与服务端成功交互的时间, 原子读写
+	listed         int32         //已成功获取服务列表, 原子读写
+	listVersion    int64         //服务列表新增服务的次数, 原子读写
+	cacheLoaded    bool          //已从快照加载服务
+	lastSnapshot   []byte        //最近一次写入的快照内容, 未变化时不再写入
+	lastPushMillis int64         //最近一次服务推送时间, 原子读写
 }
 
 type NacosClientError struct {
@@ -67,71 +156,32 @@ func exists(path string) (bool, error) {
 	return true, err
 }
 
-func initDir() {
+// homeDir returns name in the home directory of the user.
+func homeDir(name string) string {
 	dir, err := filepath.Abs(Home())
 	if err != nil {
 		os.Exit(1)
 	}
 
-	if LogPath == "" {
-		LogPath = dir + string(os.PathSeparator) + "logs"
-	}
-
-	if CachePath == "" {
-		CachePath = dir + string(os.PathSeparator) + "nacos-go-client-cache"
-	}
-
-	mkdirIfNecessary(CachePath)
+	return dir + string(os.PathSeparator) + name
 }
 
 func mkdirIfNecessary(path string) {
 	if ok, _ := exists(path); !ok {
 		err := os.Mkdir(path, 0755)
 		if err != nil {
-			NacosClientLogger.Warn("can not cread dir: "+path, err)
+			log.Warningf("Can not create dir %s: %s", path, err)
 		}
 	}
 }
 
-func initLog() {
-	if NacosClientLogger != nil {
-		return
-	}
-
-	initDir()
-	var err error
-	var nacosLogger seelog.LoggerInterface
-	if LogConfig == "" || !Exist(LogConfig) {
-		home := Home()
-		LogConfig = home
-		nacosLogger, err = seelog.LoggerFromConfigAsString(`
-    		<seelog minlevel="info" maxlevel="error">
-        		<outputs formatid="main">
-            		<buffered size="1000" flushperiod="1000">
-                		<rollingfile type="size" filename="` + home + `/logs/nacos-go-client/nacos-go-client.log" maxsize="100000000" maxrolls="10"/>
-        			</buffered>
-    			</outputs>
-    			<formats>
-        			<format id="main" format="%Date(2006-01-02 15:04:05.000) %LEVEL %Msg %n"/>
-    			</formats>
-			</seelog>
-			`)
-	} else {
-		nacosLogger, err = seelog.LoggerFromConfigAsFile(LogConfig)
-	}
-
-	fmt.Println("log directory: " + LogConfig + "/logs/nacos-go-client/")
-
-	if err != nil {
-		fmt.Println("Failed to init log, ", err)
-	} else {
-		NacosClientLogger = nacosLogger
-	}
-}
-
-func (nacosClient *NacosClient) asyncGetAllServiceNames() {
+func (nacosClient *NacosClient) asyncGetAllServiceNames(ctx context.Context) {
 	for {
-		time.Sleep(time.Duration(AllDoms.CacheSeconds) * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(nacosClient.allDoms.CacheSeconds) * time.Second):
+		}
 		nacosClient.getAllServiceNames()
 	}
 }
@@ -140,76 +190,78 @@ func (nacosClient *NacosClient) asyncGetAllServiceNames() {
 //	return &nacosClient.serverManager
 //}
 
-func (nacosClient *NacosClient) GetUdpServer() (us UDPServer) {
-	return nacosClient.udpServer
-}
-
-func (nacosClient *NacosClient) getAllServiceNames() {
+// getAllServiceNames adds the services listed by Nacos to the known ones.
+func (nacosClient *NacosClient) getAllServiceNames() error {
 
-	services := GrpcClient.GetAllServicesInfo()
+	services, err := nacosClient.naming().ListServices()
+	if err != nil {
+		log.Warningf("Failed to list services, keeping the known ones: %s", err)
+		return err
+	}
+	nacosClient.contacted()
 	if services == nil {
-		NacosClientLogger.Warn("No Service return from servers.")
-		return
+		log.Warning("No service returned from servers")
+		return nil
 	}
+	atomic.StoreInt32(&nacosClient.listed, 1)
 
-	AllDoms.DLock.Lock()
-	if AllDoms.Data == nil {
+	nacosClient.allDoms.DLock.Lock()
+	if nacosClient.allDoms.Data == nil {
 		allDoms := make(map[string]bool)
 		// record all serviceNames return from server
 		for _, service := range services {
 			allDoms[service] = true
 		}
-		AllDoms.Data = allDoms
-		AllDoms.CacheSeconds = 10 //刷新间隔
+		nacosClient.allDoms.Data = allDoms
+		nacosClient.allDoms.CacheSeconds = 10 //刷新间隔
+		atomic.AddInt64(&nacosClient.listVersion, 1)
 	} else {
 		for _, service := range services {
-			fmt.Println("get service: " + service)
-			if !AllDoms.Data[service] {
-				AllDoms.Data[service] = true
+			if !nacosClient.allDoms.Data[service] {
+				nacosClient.allDoms.Data[service] = true
+				atomic.AddInt64(&nacosClient.listVersion, 1)
 			}
 		}
 	}
-	AllDoms.DLock.Unlock()
+	nacosClient.allDoms.DLock.Unlock()
+	return nil
 }
 
 //func (nacosClient *NacosClient) SetServers(servers []string) {
 //	nacosClient.serverManager.SetServers(servers)
 //}
 
-func (vc *NacosClient) Registered(service string) bool {
-	defer AllDoms.DLock.RUnlock()
-	AllDoms.DLock.RLock()
-	_, ok1 := AllDoms.Data[service]
-
-	return ok1
-}
-
-func (vc *NacosClient) loadCache() {
-	NacosSdkCachePath := CachePath + "/naming/public/"
-	files, err := ioutil.ReadDir(NacosSdkCachePath)
-	if err != nil {
-		NacosClientLogger.Critical(err)
+// serviceKeys returns the services listed by Nacos or cached, in no order.
+func (vc *NacosClient) serviceKeys() []string {
+	keys := map[string]bool{}
+	vc.allDoms.DLock.RLock()
+	for key := range vc.allDoms.Data {
+		keys[key] = true
+	}
+	vc.allDoms.DLock.RUnlock()
+	for _, key := range vc.serviceMap.Keys() {
+		keys[key] = true
 	}
 
-	for _, f := range files {
-		fileName := NacosSdkCachePath + string(os.PathSeparator) + f.Name()
-		b, err := ioutil.ReadFile(fileName)
-		if err != nil {
-			NacosClientLogger.Error("failed to read cache file: "+fileName, err)
-		}
-
-		s := string(b)
-		var service model.Service
-		err1 := json.Unmarshal([]byte(s), &service)
+	result := make([]string, 0, len(keys))
+	for key := range keys {
+		result = append(result, key)
+	}
+	return result
+}
 
-		if err1 != nil {
-			continue
-		}
+// servicesVersion changes whenever a service is listed or cached, or leaves the
+// cache.
+func (vc *NacosClient) servicesVersion() (listed int64, cached int) {
+	return atomic.LoadInt64(&vc.listVersion), vc.serviceMap.Count()
+}
 
-		vc.serviceMap.Set(f.Name(), service)
-	}
+func (vc *NacosClient) Registered(service string) bool {
+	defer vc.allDoms.DLock.RUnlock()
+	vc.allDoms.DLock.RLock()
+	_, ok1 := vc.allDoms.Data[service]
 
-	NacosClientLogger.Info("finish loading cache, total: " + strconv.Itoa(len(files)))
+	return ok1
 }
 
 func ProcessDomainString(s string) (model.Service, error) {
@@ -217,54 +269,300 @@ func ProcessDomainString(s string) (model.Service, error) {
 	err1 := json.Unmarshal([]byte(s), &service)
 
 	if err1 != nil {
-		NacosClientLogger.Error("failed to unmarshal json string: "+s, err1)
+		log.Errorf("Failed to unmarshal service %s: %s", s, err1)
 		return model.Service{}, err1
 	}
 
 	if len(service.Hosts) == 0 {
-		NacosClientLogger.Warn("get empty ip list, ignore it, service: " + service.Name)
+		log.Warningf("Ignoring empty instance list of %s", service.Name)
 		return service, NacosClientError{"empty ip list"}
 	}
 
-	NacosClientLogger.Info("domain "+service.Name+" is updated, current ips: ", service.Hosts)
+	log.Debugf("Service %s updated, instances: %v", service.Name, service.Hosts)
 	return service, nil
 }
 
-func NewNacosClient(namespaceId string, serverHosts []string, userName, password string) *NacosClient {
-	fmt.Println("init nacos client.")
-	initLog()
-	vc := NacosClient{NewConcurrentMap(), UDPServer{}}
-	vc.loadCache()
-	vc.udpServer.vipClient = &vc
-	//init grpcClient
-	var err error
-	GrpcClient, err = NewNacosGrpcClient(namespaceId, serverHosts, userName, password, &vc)
+// NewNacosClient returns a client which connects to Nacos, and reads its
+// snapshot, on Start. Nothing is opened before, so a Corefile which fails to
+// load after parsing the client leaks no connection.
+func NewNacosClient(config NacosClientConfig) *NacosClient {
+	if config.CachePath == "" {
+		config.CachePath = homeDir("nacos-go-client-cache")
+	}
+	return newNacosClient(config, nil)
+}
+
+// open loads the snapshot and connects to Nacos, unless the client was given
+// a backend.
+func (vc *NacosClient) open() {
+	if vc.naming() != nil {
+		return
+	}
+	mkdirIfNecessary(vc.config.CachePath)
+	vc.loadSnapshot()
+	log.Infof("Cache path: %s", vc.config.CachePath)
+
+	backend, err := newBackend(vc.config)
 	if err != nil {
-		NacosClientLogger.Error("init nacos-grpc-client failed.", err)
+		log.Errorf("Failed to init nacos %s client: %s", vc.config.protocol(), err)
 	}
+	vc.backendLock.Lock()
+	vc.backend = backend
+	vc.backendLock.Unlock()
+}
 
-	if EnableReceivePush {
-		go vc.udpServer.StartServer()
+// newBackend connects to Nacos with the configured protocol. The backend is
+// usable, though failing, on errors.
+func newBackend(config NacosClientConfig) (NamingBackend, error) {
+	if config.protocol() == ProtocolHttp {
+		return NewNacosHttpClient(config)
 	}
+	return NewNacosGrpcClient(config)
+}
 
-	AllDoms = AllDomsMap{}
-	AllDoms.Data = make(map[string]bool)
-	AllDoms.DLock = sync.RWMutex{}
-	AllDoms.CacheSeconds = 10
+func newNacosClient(config NacosClientConfig, backend NamingBackend) *NacosClient {
+	vc := NacosClient{
+		config:         config,
+		backend:        backend,
+		password:       config.Password,
+		secretKey:      config.SecretKey,
+		serviceMap:     NewConcurrentMap(),
+		dnsCache:       NewConcurrentMap(),
+		indexMap:       NewConcurrentMap(),
+		syncMillis:     NewConcurrentMap(),
+		metadata:       NewConcurrentMap(),
+		protected:      NewConcurrentMap(),
+		subscribing:    make(map[string]int64),
+		lastPushMillis: CurrentMillis(),
+		contactMillis:  CurrentMillis(),
+	}
+
+	vc.allDoms = AllDomsMap{}
+	vc.allDoms.Data = make(map[string]bool)
+	vc.allDoms.DLock = sync.RWMutex{}
+	vc.allDoms.CacheSeconds = 10
+	vc.subscribed = AllDomsMap{}
+	vc.subscribed.Data = make(map[string]bool)
+
+	return &vc
+}
+
+// Start connects to Nacos, lists the services and runs the background workers
+// until Stop.
+func (vc *NacosClient) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	vc.cancel = cancel
 
+	vc.open()
 	vc.getAllServiceNames()
 
-	//go vc.asyncGetAllServiceNames()
-	go vc.asyncUpdateDomain()
+	clientMetrics.add(vc)
+	vc.goWorker(ctx, vc.asyncGetAllServiceNames)
+	vc.goWorker(ctx, vc.asyncUpdateDomain)
+	vc.goWorker(ctx, vc.asyncUpdateMetadata)
+	vc.goWorker(ctx, vc.asyncSaveSnapshot)
+	if vc.config.PasswordFile != "" || vc.config.SecretKeyFile != "" {
+		vc.goWorker(ctx, vc.asyncReloadCredentials)
+	}
+}
 
-	NacosClientLogger.Info("cache-path: " + CachePath)
-	return &vc
+func (vc *NacosClient) goWorker(ctx context.Context, worker func(context.Context)) {
+	vc.workers.Add(1)
+	go func() {
+		defer vc.workers.Done()
+		worker(ctx)
+	}()
+}
+
+// Stop ends the background workers, unsubscribes every service and closes the
+// connection to Nacos.
+func (vc *NacosClient) Stop() {
+	if vc.cancel != nil {
+		vc.cancel()
+	}
+	vc.workers.Wait()
+	vc.subscribeLock.Lock()
+	vc.stopped = true
+	vc.subscribeLock.Unlock()
+	vc.subscribers.Wait()
+	clientMetrics.remove(vc)
+	if err := vc.saveSnapshot(); err != nil {
+		log.Warningf("Failed to save snapshot: %s", err)
+	}
+
+	vc.subscribed.DLock.RLock()
+	var subscribed []string
+	for serviceKey := range vc.subscribed.Data {
+		subscribed = append(subscribed, serviceKey)
+	}
+	vc.subscribed.DLock.RUnlock()
+
+	for _, serviceKey := range subscribed {
+		vc.Unsubscribe(serviceKey)
+	}
+	if backend := vc.naming(); backend != nil {
+		backend.Close()
+	}
+	log.Infof("Nacos client stopped, cache path: %s", vc.config.CachePath)
+}
+
+func (vc *NacosClient) naming() NamingBackend {
+	vc.backendLock.RLock()
+	defer vc.backendLock.RUnlock()
+	return vc.backend
+}
+
+// Subscribe asks the backend to push the changes of a service.
+func (vc *NacosClient) Subscribe(serviceKey string) error {
+	if vc.Subscribed(serviceKey) {
+		log.Debugf("Service %s already subscribed", serviceKey)
+		return nil
+	}
+	if err := vc.naming().Subscribe(serviceKey, vc.onPush); err != nil {
+		log.Errorf("Failed to subscribe to %s: %s", serviceKey, err)
+		return err
+	}
+
+	vc.subscribed.DLock.Lock()
+	defer vc.subscribed.DLock.Unlock()
+	vc.subscribed.Data[serviceKey] = true
+	return nil
+}
+
+// subscribeBackoff is how long queries leave a service alone after subscribing
+// to it failed.
+var subscribeBackoff = 10 * time.Second
+
+// asyncSubscribe subscribes to a service in the background, so queries answer
+// from the cache without waiting for Nacos. Nothing is done while an attempt
+// runs or within subscribeBackoff of a failed one.
+func (vc *NacosClient) asyncSubscribe(serviceKey string) {
+	if vc.Subscribed(serviceKey) {
+		return
+	}
+
+	vc.subscribeLock.Lock()
+	defer vc.subscribeLock.Unlock()
+	failed, ok := vc.subscribing[serviceKey]
+	if vc.stopped || ok && (failed == 0 || CurrentMillis()-failed < subscribeBackoff.Milliseconds()) {
+		return
+	}
+	vc.subscribing[serviceKey] = 0
+	vc.subscribers.Add(1)
+
+	go func() {
+		defer vc.subscribers.Done()
+		// not pushed either, read before the first answers live long with it
+		vc.refreshMetadata(serviceKey)
+		err := vc.Subscribe(serviceKey)
+
+		vc.subscribeLock.Lock()
+		defer vc.subscribeLock.Unlock()
+		if err != nil {
+			vc.subscribing[serviceKey] = CurrentMillis()
+		} else {
+			delete(vc.subscribing, serviceKey)
+		}
+	}()
+}
+
+func (vc *NacosClient) Unsubscribe(serviceKey string) error {
+	if !vc.Subscribed(serviceKey) {
+		return nil
+	}
+	if err := vc.naming().Unsubscribe(serviceKey); err != nil {
+		log.Errorf("Failed to unsubscribe from %s: %s", serviceKey, err)
+		return err
+	}
+
+	vc.subscribed.DLock.Lock()
+	defer vc.subscribed.DLock.Unlock()
+	delete(vc.subscribed.Data, serviceKey)
+	return nil
+}
+
+func (vc *NacosClient) Subscribed(serviceKey string) bool {
+	vc.subscribed.DLock.RLock()
+	defer vc.subscribed.DLock.RUnlock()
+	return vc.subscribed.Data[serviceKey]
+}
+
+// onPush updates a subscribed service with the instances pushed by the backend.
+func (vc *NacosClient) onPush(serviceKey string, instances []model.Instance) {
+	atomic.StoreInt64(&vc.lastPushMillis, CurrentMillis())
+	vc.syncMillis.Set(serviceKey, CurrentMillis())
+	vc.contacted()
+	pushCount.WithLabelValues(serviceKey).Inc()
+
+	//服务下线,更新实例数量为0
+	if len(instances) == 0 {
+		service, _ := vc.naming().GetService(serviceKey)
+		if len(service.Hosts) == 0 {
+			if old, ok := vc.serviceMap.Get(serviceKey); ok {
+				service = old.(model.Service)
+				service.Hosts = nil
+			}
+			vc.serviceMap.Set(serviceKey, service)
+			vc.InvalidateDNSCache(serviceKey)
+			vc.Unsubscribe(serviceKey)
+		}
+		return
+	}
+
+	oldService, ok := vc.serviceMap.Get(serviceKey)
+	if !ok {
+		log.Debugf("Service %s not found in cache", serviceKey)
+		service, _ := vc.naming().GetService(serviceKey)
+		service.Hosts = instances
+		vc.serviceMap.Set(serviceKey, service)
+	} else {
+		service := oldService.(model.Service)
+		service.Hosts = instances
+		service.LastRefTime = uint64(CurrentMillis())
+		vc.serviceMap.Set(serviceKey, service)
+	}
+	vc.InvalidateDNSCache(serviceKey)
+	log.Debugf("Service %s pushed, instances: %v", serviceKey, instances)
+}
+
+// LastPushMillis returns when Nacos last pushed a service change, or when the
+// client was created if nothing was pushed since.
+func (vc *NacosClient) LastPushMillis() int64 {
+	return atomic.LoadInt64(&vc.lastPushMillis)
 }
 
 func (vc *NacosClient) GetDomainCache() ConcurrentMap {
 	return vc.serviceMap
 }
 
+// GetDNSCache returns the cached responses, see DnsCache.
+func (vc *NacosClient) GetDNSCache() ConcurrentMap {
+	return vc.dnsCache
+}
+
+// InvalidateDNSCache drops the cached responses of a service.
+func (vc *NacosClient) InvalidateDNSCache(serviceKey string) {
+	vc.removeDNSCache(func(entry DnsCache) bool { return entry.Service == serviceKey })
+}
+
+// purgeDNSCache drops the expired responses.
+func (vc *NacosClient) purgeDNSCache() {
+	vc.removeDNSCache(func(entry DnsCache) bool { return !entry.Updated() })
+}
+
+func (vc *NacosClient) removeDNSCache(match func(DnsCache) bool) {
+	var keys []string
+	// IterCb holds the shard locks, remove afterwards
+	vc.dnsCache.IterCb(func(key string, v interface{}) {
+		if match(v.(DnsCache)) {
+			keys = append(keys, key)
+		}
+	})
+	for _, key := range keys {
+		vc.dnsCache.Remove(key)
+	}
+}
+
 func (vc *NacosClient) GetDomain(name string) (*Domain, error) {
 	item, _ := vc.serviceMap.Get(name)
 
@@ -285,21 +583,70 @@ func (vc *NacosClient) GetDomain(name string) (*Domain, error) {
 	return &domain, nil
 }
 
-func (vc *NacosClient) asyncUpdateDomain() {
+func (vc *NacosClient) asyncUpdateDomain(ctx context.Context) {
 	for {
-		for k, _ := range vc.serviceMap.Items() {
-			ss := strings.Split(k, SEPERATOR)
-			serviceName := ss[0]
-			var clientIP string
-			if len(ss) > 1 && ss[1] != "" {
-				clientIP = ss[1]
-				serviceName = ss[1]
+		// keys are group qualified service names, see ServiceKey
+		for serviceKey, _ := range vc.serviceMap.Items() {
+			vc.getServiceNow(serviceKey, &vc.serviceMap, "")
+		}
+		vc.purgeDNSCache()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
+
+// metadataInterval is how often the metadata of the cached services is read.
+var metadataInterval = 30 * time.Second
+
+// asyncUpdateMetadata reads the metadata of the cached services, which Nacos
+// neither pushes nor returns with the instances.
+func (vc *NacosClient) asyncUpdateMetadata(ctx context.Context) {
+	for {
+		failed := 0
+		var err error
+		for _, serviceKey := range vc.serviceMap.Keys() {
+			if e := vc.refreshMetadata(serviceKey); e != nil {
+				failed, err = failed+1, e
 			}
-			vc.getServiceNow(serviceName, &vc.serviceMap, clientIP)
 		}
-		time.Sleep(3 * time.Second)
+		if failed > 0 {
+			log.Warningf("Failed to get the metadata of %d services, keeping the known one: %s", failed, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(metadataInterval):
+		}
 	}
+}
 
+// refreshMetadata fetches the metadata of a service, dropping its cached
+// answers when it changed.
+func (vc *NacosClient) refreshMetadata(serviceKey string) error {
+	metadata, err := vc.naming().GetServiceMetadata(serviceKey)
+	if err != nil {
+		return err
+	}
+	if old := vc.ServiceMetadata(serviceKey); len(old) == 0 && len(metadata) == 0 || reflect.DeepEqual(old, metadata) {
+		return nil
+	}
+	vc.metadata.Set(serviceKey, metadata)
+	vc.InvalidateDNSCache(serviceKey)
+	log.Debugf("Service %s metadata updated: %v", serviceKey, metadata)
+	return nil
+}
+
+// ServiceMetadata returns the last read metadata of a service, nil before.
+func (vc *NacosClient) ServiceMetadata(serviceKey string) map[string]string {
+	if item, ok := vc.metadata.Get(serviceKey); ok {
+		return item.(map[string]string)
+	}
+	return nil
 }
 
 func GetCacheKey(dom, clientIP string) string {
@@ -310,13 +657,37 @@ func GetCacheKeyV2(dom string) string {
 	return dom
 }
 func (vc *NacosClient) getServiceNow(serviceName string, cache *ConcurrentMap, clientIP string) model.Service {
-	service := GrpcClient.GetService(serviceName)
+	service, _ := vc.refreshService(serviceName, cache)
+	return service
+}
 
+// refreshService fetches a service from Nacos into cache. On errors it returns
+// the cached service, if any, with the error.
+func (vc *NacosClient) refreshService(serviceName string, cache *ConcurrentMap) (model.Service, error) {
+	start := time.Now()
+	service, err := vc.naming().GetService(serviceName)
+	getServiceDuration.WithLabelValues(vc.config.NamespaceId).Observe(time.Since(start).Seconds())
+
+	old, ok := cache.Get(serviceName)
+	if err != nil {
+		getServiceErrors.WithLabelValues(serviceName).Inc()
+		// keep answering from the last known state while the server is unreachable
+		log.Warningf("Failed to get service %s from server: %s", serviceName, err)
+		if ok {
+			return old.(model.Service), err
+		}
+		return service, err
+	}
 	cache.Set(serviceName, service)
+	vc.syncMillis.Set(serviceName, CurrentMillis())
+	vc.contacted()
+	if ok && !reflect.DeepEqual(old.(model.Service).Hosts, service.Hosts) {
+		vc.InvalidateDNSCache(serviceName)
+	}
 
-	NacosClientLogger.Info("dom "+serviceName+" updated: ", service)
+	log.Debugf("Service %s updated: %v", serviceName, service)
 
-	return service
+	return service, nil
 }
 
 func (vc *NacosClient) SrvInstance(serviceName, clientIP string) *model.Instance {
@@ -338,11 +709,11 @@ func (vc *NacosClient) SrvInstance(serviceName, clientIP string) *model.Instance
 	}
 
 	if len(hosts) == 0 {
-		NacosClientLogger.Warn("no healthy instances for " + serviceName)
+		log.Warningf("No healthy instances for %s", serviceName)
 		return nil
 	}
 
-	i, indexOk := indexMap.Get(serviceName)
+	i, indexOk := vc.indexMap.Get(serviceName)
 	var index int
 
 	if !indexOk {
@@ -355,37 +726,74 @@ func (vc *NacosClient) SrvInstance(serviceName, clientIP string) *model.Instance
 		}
 	}
 
-	indexMap.Set(serviceName, index)
+	vc.indexMap.Set(serviceName, index)
 
 	return &hosts[index]
 }
 
-func (vc *NacosClient) SrvInstances(domainName, clientIP string) []model.Instance {
+// GetService returns a service from the cache, fetching it on a miss.
+func (vc *NacosClient) GetService(domainName, clientIP string) model.Service {
 	cacheKey := GetCacheKeyV2(domainName)
 	item, hasDom := vc.serviceMap.Get(cacheKey)
-	var dom model.Service
 	if !hasDom {
-		dom = vc.getServiceNow(domainName, &vc.serviceMap, clientIP)
+		dom := vc.getServiceNow(domainName, &vc.serviceMap, clientIP)
 		vc.serviceMap.Set(cacheKey, dom)
-	} else {
-		dom = item.(model.Service)
+		return dom
 	}
+	return item.(model.Service)
+}
 
-	var hosts []model.Instance
+// SrvInstances returns the healthy instances of a service, limited to the
+// given clusters if any are passed. When Nacos reports the protect threshold of
+// the service reached, or the healthy ratio drops to ProtectThreshold, it
+// returns the unhealthy instances as well so that the few healthy ones are not
+// overloaded.
+func (vc *NacosClient) SrvInstances(domainName, clientIP string, clusters ...string) []model.Instance {
+	dom := vc.GetService(domainName, clientIP)
+
+	var enabled, hosts []model.Instance
 	//select healthy instances
 	for _, host := range dom.Hosts {
-		if host.Healthy && host.Enable && host.Weight > 0 {
-			// don't use weight for now
-			// for i := 0; i < int(math.Ceil(host.Weight)); i++ {
-			// 	hosts = append(hosts, host)
-			// }
+		if !inClusters(host, clusters) || !host.Enable || host.Weight <= 0 {
+			continue
+		}
+		enabled = append(enabled, host)
+		if host.Healthy {
 			hosts = append(hosts, host)
 		}
 	}
 
+	// logged and counted once per change, not on every query of a protected service
+	protectKey := domainName + "/" + strings.Join(clusters, ",")
+	threshold := vc.config.ProtectThreshold
+	if len(hosts) < len(enabled) && (dom.ReachProtectionThreshold ||
+		threshold > 0 && float64(len(hosts)) <= threshold*float64(len(enabled))) {
+		if vc.protected.SetIfAbsent(protectKey, true) {
+			log.Warningf("Protect threshold reached for %s, %d of %d instances healthy, serving all of them",
+				domainName, len(hosts), len(enabled))
+			protectThresholdCount.WithLabelValues(domainName).Inc()
+		}
+		return enabled
+	}
+	if _, ok := vc.protected.Pop(protectKey); ok {
+		log.Infof("Protect threshold no longer reached for %s, %d of %d instances healthy",
+			domainName, len(hosts), len(enabled))
+	}
 	return hosts
 }
 
+func inClusters(host model.Instance, clusters []string) bool {
+	if len(clusters) == 0 {
+		return true
+	}
+	for _, cluster := range clusters {
+		if strings.EqualFold(host.ClusterName, cluster) {
+			return true
+		}
+	}
+	return false
+}
+
 func (vc *NacosClient) Contains(dom, clientIP string, host model.Instance) bool {
 	hosts := vc.SrvInstances(dom, clientIP)
 
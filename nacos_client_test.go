@@ -14,12 +14,17 @@
 package nacos
 
 import (
+	"bytes"
 	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	golog "log"
 	"net/http"
 	"net/http/httptest"
-	"sync"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNacosClient_GetDomain(t *testing.T) {
@@ -51,53 +56,159 @@ func TestNacosClient_GetDomain(t *testing.T) {
 var nacosClientTest = NewNacosClientTEST()
 
 func NewNacosClientTEST() *NacosClient {
-	vc := NacosClient{NewConcurrentMap(), UDPServer{}}
-	vc.udpServer.vipClient = &vc
-	AllDoms = AllDomsMap{}
-	AllDoms.Data = make(map[string]bool)
-	AllDoms.DLock = sync.RWMutex{}
-	return &vc
+	return newNacosClient(NacosClientConfig{}, newFakeBackend(
+		testService("demo.go", "10.10.10.10", "10.10.10.11"),
+		testGroupService("orders", "PAYMENT_GROUP", "10.0.0.1"),
+	))
 }
 
 func TestNacosClient_getAllServiceNames(t *testing.T) {
-	GrpcClient = grpcClientTest
 	nacosClientTest.getAllServiceNames()
 
-	AllDoms.DLock.Lock()
-	defer AllDoms.DLock.Unlock()
-	doms := GrpcClient.GetAllServicesInfo()
+	nacosClientTest.allDoms.DLock.Lock()
+	defer nacosClientTest.allDoms.DLock.Unlock()
+	doms, err := nacosClientTest.backend.ListServices()
+	assert.NoError(t, err)
 
 	for _, dom := range doms {
-		assert.True(t, AllDoms.Data[dom])
-	}
-	if len(doms) == len(AllDoms.Data) {
-		t.Log("Get all serviceName from servers passed")
-	} else {
-		t.Error("Get all serviceName from servers error")
+		assert.True(t, nacosClientTest.allDoms.Data[dom])
 	}
+	assert.Equal(t, len(doms), len(nacosClientTest.allDoms.Data))
 }
 
 func TestNacosClient_getServiceNow(t *testing.T) {
-	GrpcClient = grpcClientTest
 	nacosClientTest.getAllServiceNames()
-	testServiceMap := NewConcurrentMap()
 
-	for serviceName, _ := range AllDoms.Data {
+	for serviceName, _ := range nacosClientTest.allDoms.Data {
 		nacosClientTest.getServiceNow(serviceName, &nacosClientTest.serviceMap, "0.0.0.0")
 	}
 
-	for serviceName, _ := range AllDoms.Data {
-		testService := GrpcClient.GetService(serviceName)
-		testServiceMap.Set(serviceName, testService)
+	for serviceName, _ := range nacosClientTest.allDoms.Data {
+		testService, _ := nacosClientTest.backend.GetService(serviceName)
 		s, ok := nacosClientTest.GetDomainCache().Get(serviceName)
 		assert.True(t, ok)
 		service := s.(model.Service)
 		assert.True(t, len(service.Hosts) == len(testService.Hosts))
 	}
+	assert.Equal(t, 2, nacosClientTest.GetDomainCache().Count())
+}
+
+func TestNacosClient_onPush(t *testing.T) {
+	vc := NewNacosClientTEST()
+	services := testService("demo.go", "10.10.10.10", "10.10.10.11", "10.10.10.12", "10.10.10.13", "10.10.10.14")
+	services.Hosts[2].Healthy = false
+	services.Hosts[3].Enable = false
+	services.Hosts[4].Weight = 0
+	vc.GetDomainCache().Set("DEFAULT_GROUP@@demo.go", services)
+	assert.NoError(t, vc.Subscribe("DEFAULT_GROUP@@demo.go"))
+
+	newServices := services
+	newServices.Hosts = services.Hosts[:4]
+	vc.backend.(*fakeBackend).SetService(newServices)
+
+	s, _ := vc.GetDomainCache().Get("DEFAULT_GROUP@@demo.go")
+	assert.Len(t, s.(model.Service).Hosts, 4)
+	assert.Len(t, vc.SrvInstances("DEFAULT_GROUP@@demo.go", ""), 2)
+}
+
+func TestNacosClient_StartStop(t *testing.T) {
+	vc := NewNacosClientTEST()
+	vc.Start()
+	assert.Equal(t, 2, len(vc.allDoms.Data))
+
+	stopped := make(chan struct{})
+	go func() {
+		vc.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("background workers did not stop")
+	}
+	assert.True(t, vc.backend.(*fakeBackend).closed)
+}
 
-	if len(nacosClientTest.GetDomainCache()) == len(testServiceMap) {
-		t.Log("Get all servicesInfo from servers passed")
-	} else {
-		t.Error("Get all servicesInfo from servers error")
+func TestNacosClient_SrvInstancesProtectThreshold(t *testing.T) {
+	service := testService("orders", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6")
+	for i := 1; i < 4; i++ {
+		service.Hosts[i].Healthy = false
+	}
+	service.Hosts[4].Enable = false
+	service.Hosts[5].Weight = 0
+	vc := NewNacosClientTEST()
+	vc.serviceMap.Set("DEFAULT_GROUP@@orders", service)
+	reached := protectThresholdCount.WithLabelValues("DEFAULT_GROUP@@orders")
+
+	tests := []struct {
+		threshold float64
+		reached   bool
+		expected  int
+	}{
+		{0, false, 1},
+		{0.2, false, 1},
+		{0.25, false, 4},
+		{1, false, 4},
+		{0, true, 4},
 	}
+
+	// counted when entering protection only
+	protected := false
+	for _, test := range tests {
+		vc.config.ProtectThreshold = test.threshold
+		service.ReachProtectionThreshold = test.reached
+		vc.serviceMap.Set("DEFAULT_GROUP@@orders", service)
+
+		before := testutil.ToFloat64(reached)
+		hosts := vc.SrvInstances("DEFAULT_GROUP@@orders", "")
+		assert.Len(t, hosts, test.expected, "threshold %v", test.threshold)
+		for _, host := range hosts {
+			assert.True(t, host.Enable && host.Weight > 0)
+		}
+		if test.expected > 1 && !protected {
+			assert.Equal(t, before+1, testutil.ToFloat64(reached))
+		} else {
+			assert.Equal(t, before, testutil.ToFloat64(reached))
+		}
+		protected = test.expected > 1
+	}
+
+	// nothing to protect when every instance is healthy
+	vc.config.ProtectThreshold = 1
+	vc.serviceMap.Set("DEFAULT_GROUP@@orders", testService("orders", "10.0.0.1"))
+	before := testutil.ToFloat64(reached)
+	assert.Len(t, vc.SrvInstances("DEFAULT_GROUP@@orders", ""), 1)
+	assert.Equal(t, before, testutil.ToFloat64(reached))
+}
+
+func TestNacosClient_SrvInstancesProtectThresholdLog(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+
+	flapping := testService("orders", "10.0.0.1", "10.0.0.2")
+	flapping.Hosts[1].Healthy = false
+	vc := NewNacosClientTEST()
+	vc.config.ProtectThreshold = 0.5
+
+	// only entering and leaving protection is logged and counted, not every query
+	reached := protectThresholdCount.WithLabelValues("DEFAULT_GROUP@@orders")
+	before := testutil.ToFloat64(reached)
+	vc.serviceMap.Set("DEFAULT_GROUP@@orders", flapping)
+	for i := 0; i < 10; i++ {
+		assert.Len(t, vc.SrvInstances("DEFAULT_GROUP@@orders", ""), 2)
+	}
+	assert.Equal(t, 1, strings.Count(buf.String(), "Protect threshold reached for DEFAULT_GROUP@@orders"))
+	assert.Equal(t, before+1, testutil.ToFloat64(reached))
+
+	vc.serviceMap.Set("DEFAULT_GROUP@@orders", testService("orders", "10.0.0.1", "10.0.0.2"))
+	for i := 0; i < 10; i++ {
+		assert.Len(t, vc.SrvInstances("DEFAULT_GROUP@@orders", ""), 2)
+	}
+	assert.Equal(t, 1, strings.Count(buf.String(), "Protect threshold no longer reached for DEFAULT_GROUP@@orders"))
+
+	vc.serviceMap.Set("DEFAULT_GROUP@@orders", flapping)
+	vc.SrvInstances("DEFAULT_GROUP@@orders", "")
+	assert.Equal(t, 2, strings.Count(buf.String(), "Protect threshold reached for DEFAULT_GROUP@@orders"))
+	assert.Equal(t, before+2, testutil.ToFloat64(reached))
 }
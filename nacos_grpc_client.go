@@ -1,49 +1,75 @@
 package nacos
 
 import (
-	"fmt"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"sync"
 
 	"github.com/nacos-group/nacos-sdk-go/v2/clients"
 	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
 	"github.com/nacos-group/nacos-sdk-go/v2/common/constant"
+	sdklogger "github.com/nacos-group/nacos-sdk-go/v2/common/logger"
 	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/util"
 	"github.com/nacos-group/nacos-sdk-go/v2/vo"
 )
 
+// ServiceKey returns the group qualified name ("group@@service") under which
+// a service is listed, cached and subscribed.
+func ServiceKey(serviceName, groupName string) string {
+	if groupName == "" {
+		groupName = constant.DEFAULT_GROUP
+	}
+	return util.GetGroupName(serviceName, groupName)
+}
+
+// SplitServiceKey is the reverse of ServiceKey. Names without a group prefix
+// belong to DEFAULT_GROUP.
+func SplitServiceKey(key string) (serviceName, groupName string) {
+	if i := strings.Index(key, SEPERATOR); i >= 0 {
+		return key[i+len(SEPERATOR):], key[:i]
+	}
+	return key, constant.DEFAULT_GROUP
+}
+
+// NacosGrpcClient is the NamingBackend of the Nacos v2 SDK.
 type NacosGrpcClient struct {
 	namespaceId   string
 	clientConfig  constant.ClientConfig       //nacos-coredns客户端配置
 	serverConfigs []constant.ServerConfig     //nacos服务器集群配置
 	grpcClient    naming_client.INamingClient //nacos-coredns与nacos服务器的grpc连接
-	nacosClient   *NacosClient
-	SubscribeMap  AllDomsMap
+	groups        []string                    //服务分组, 列出服务时逐个查询
+	params        map[string]*vo.SubscribeParam
+	paramsLock    sync.Mutex
+	v1            *NacosHttpClient //gRPC API不提供服务元数据, 经v1 API读取
 }
 
-func NewNacosGrpcClient(namespaceId string, serverHosts []string, userName, password string, vc *NacosClient) (*NacosGrpcClient, error) {
+func NewNacosGrpcClient(config NacosClientConfig) (*NacosGrpcClient, error) {
 	var nacosGrpcClient NacosGrpcClient
-	nacosGrpcClient.nacosClient = vc
+	groups := config.Groups
+	if len(groups) == 0 {
+		groups = []string{constant.DEFAULT_GROUP}
+	}
+	nacosGrpcClient.groups = groups
+	namespaceId := config.NamespaceId
 	if namespaceId == "public" {
 		namespaceId = ""
 	}
 	nacosGrpcClient.namespaceId = namespaceId //When namespace is public, fill in the blank string here.
 
-	serverConfigs := make([]constant.ServerConfig, len(serverHosts))
-	for i, serverHost := range serverHosts {
-		serverIp := strings.Split(serverHost, ":")[0]
-		serverPort, err := strconv.Atoi(strings.Split(serverHost, ":")[1])
+	var serverConfigs []constant.ServerConfig
+	for _, serverHost := range config.ServerHosts {
+		serverIp, serverPort, err := parseServerHost(serverHost)
 		if err != nil {
-			NacosClientLogger.Error("nacos server host config error!", err)
+			log.Errorf("Invalid nacos server host %s: %s", serverHost, err)
+			continue
 		}
-		serverConfigs[i] = *constant.NewServerConfig(
+		serverConfigs = append(serverConfigs, *constant.NewServerConfig(
 			serverIp,
-			uint64(serverPort),
-			constant.WithScheme("http"),
-			constant.WithContextPath("/nacos"),
-		)
-
+			serverPort,
+			constant.WithScheme(config.scheme()),
+			constant.WithContextPath(config.contextPath()),
+		))
 	}
 	nacosGrpcClient.serverConfigs = serverConfigs
 
@@ -52,140 +78,153 @@ func NewNacosGrpcClient(namespaceId string, serverHosts []string, userName, pass
 		constant.WithTimeoutMs(5000),
 		constant.WithNotLoadCacheAtStart(true),
 		constant.WithUpdateCacheWhenEmpty(true),
-		constant.WithUsername(userName),
-		constant.WithPassword(password),
-		constant.WithLogDir(LogPath),
-		constant.WithCacheDir(CachePath),
-		constant.WithLogLevel("debug"),
+		constant.WithUsername(config.Username),
+		constant.WithPassword(config.Password),
+		constant.WithAccessKey(config.AccessKey),
+		constant.WithSecretKey(config.SecretKey),
+		// the SDK logs to a file until it is handed sdkLogger below
+		constant.WithLogDir(filepath.Join(config.CachePath, "log")),
+		constant.WithCacheDir(config.CachePath),
+		constant.WithLogLevel(config.logLevel()),
 	)
+	if config.TLS.Enable {
+		nacosGrpcClient.clientConfig.TLSCfg = config.TLS
+	}
+
+	v1, err := NewNacosHttpClient(config)
+	if err != nil {
+		log.Errorf("Failed to init nacos http client, service metadata is not read: %s", err)
+	} else {
+		nacosGrpcClient.v1 = v1
+	}
 
-	var err error
 	nacosGrpcClient.grpcClient, err = clients.NewNamingClient(
 		vo.NacosClientParam{
 			ClientConfig:  &nacosGrpcClient.clientConfig,
 			ServerConfigs: nacosGrpcClient.serverConfigs,
 		},
 	)
+	sdklogger.SetLogger(sdkLogger{})
 	if err != nil {
-		fmt.Println("init nacos-client error")
+		log.Errorf("Failed to init nacos client: %s", err)
 	}
-	nacosGrpcClient.SubscribeMap = AllDomsMap{}
-	nacosGrpcClient.SubscribeMap.Data = make(map[string]bool)
-	nacosGrpcClient.SubscribeMap.DLock = sync.RWMutex{}
+	nacosGrpcClient.params = make(map[string]*vo.SubscribeParam)
 
 	return &nacosGrpcClient, err
 }
 
-func (ngc *NacosGrpcClient) GetAllServicesInfo() []string {
-	var pageNo = uint32(1)
-	var pageSize = uint32(100)
+// ListServices lists the services of every configured group, returning their
+// group qualified names.
+func (ngc *NacosGrpcClient) ListServices() ([]string, error) {
+	if ngc.grpcClient == nil {
+		return nil, NacosClientError{"nacos naming client is not initialized"}
+	}
+
 	var services []string
+	for _, group := range ngc.groups {
+		serviceNames, err := ngc.getGroupServicesInfo(group)
+		if err != nil {
+			return nil, err
+		}
+		for _, serviceName := range serviceNames {
+			services = append(services, ServiceKey(serviceName, group))
+		}
+	}
+	return services, nil
+}
 
-	pageServiceList, _ := ngc.grpcClient.GetAllServicesInfo(vo.GetAllServiceInfoParam{
-		NameSpace: ngc.namespaceId,
-		PageNo:    pageNo,
-		PageSize:  pageSize,
-	})
-	services = append(services, pageServiceList.Doms...)
+func (ngc *NacosGrpcClient) getGroupServicesInfo(group string) ([]string, error) {
+	var pageSize = uint32(100)
+	var services []string
 
 	// 如果当前页数服务数满了, 继续查找添加下一页
-	for pageNo++; len(pageServiceList.Doms) >= int(pageSize); pageNo++ {
-		pageServiceList, _ = ngc.grpcClient.GetAllServicesInfo(vo.GetAllServiceInfoParam{
+	for pageNo := uint32(1); ; pageNo++ {
+		pageServiceList, err := ngc.grpcClient.GetAllServicesInfo(vo.GetAllServiceInfoParam{
 			NameSpace: ngc.namespaceId,
+			GroupName: group,
 			PageNo:    pageNo,
 			PageSize:  pageSize,
 		})
+		if err != nil {
+			return nil, err
+		}
 		services = append(services, pageServiceList.Doms...)
+		if len(pageServiceList.Doms) < int(pageSize) {
+			return services, nil
+		}
 	}
-	return services
-
 }
 
-func (ngc *NacosGrpcClient) GetService(serviceName string) model.Service {
-	service, _ := ngc.grpcClient.GetService(vo.GetServiceParam{
+// GetService fetches a service by its group qualified name, see ServiceKey.
+func (ngc *NacosGrpcClient) GetService(serviceKey string) (model.Service, error) {
+	if ngc.grpcClient == nil {
+		return model.Service{}, NacosClientError{"nacos naming client is not initialized"}
+	}
+
+	serviceName, groupName := SplitServiceKey(serviceKey)
+	service, err := ngc.grpcClient.GetService(vo.GetServiceParam{
 		ServiceName: serviceName,
+		GroupName:   groupName,
 	})
-	if service.Hosts == nil {
-		NacosClientLogger.Warn("empty result from server, dom:" + serviceName)
+	if err == nil && service.Hosts == nil {
+		log.Warningf("Empty result from server for %s", serviceKey)
 	}
 
-	return service
+	return service, err
 }
 
-func (ngc *NacosGrpcClient) Subscribe(serviceName string) error {
-	if ngc.HasSubcribed(serviceName) {
-		NacosClientLogger.Info("service " + serviceName + " already subsrcibed.")
-		return nil
+// GetServiceMetadata reads the metadata of a service from the v1 API, the
+// gRPC API of the SDK only returns instances.
+func (ngc *NacosGrpcClient) GetServiceMetadata(serviceKey string) (map[string]string, error) {
+	if ngc.v1 == nil {
+		return nil, NacosClientError{"nacos http client is not initialized"}
 	}
-	param := &vo.SubscribeParam{
-		ServiceName:       serviceName,
-		GroupName:         "",
-		SubscribeCallback: ngc.Callback,
-	}
-	if err := ngc.grpcClient.Subscribe(param); err != nil {
-		NacosClientLogger.Error("service subscribe error " + serviceName)
-		return err
-	}
-
-	defer ngc.SubscribeMap.DLock.Unlock()
-	ngc.SubscribeMap.DLock.Lock()
-	ngc.SubscribeMap.Data[serviceName] = true
-
-	return nil
+	return ngc.v1.GetServiceMetadata(serviceKey)
 }
 
-func (ngc *NacosGrpcClient) Unsubsrcibe(serviceName string) error {
-	if !ngc.HasSubcribed(serviceName) {
-		NacosClientLogger.Info("service " + serviceName + " already unsubsrcibed.")
-		return nil
+func (ngc *NacosGrpcClient) Subscribe(serviceKey string, push PushFunc) error {
+	if ngc.grpcClient == nil {
+		return NacosClientError{"nacos naming client is not initialized"}
 	}
+
+	serviceName, groupName := SplitServiceKey(serviceKey)
 	param := &vo.SubscribeParam{
-		ServiceName:       serviceName,
-		GroupName:         "",
-		SubscribeCallback: ngc.Callback,
+		ServiceName: serviceName,
+		GroupName:   groupName,
+		SubscribeCallback: func(instances []model.Instance, err error) {
+			if err != nil {
+				log.Errorf("Push error for %s: %s", serviceKey, err)
+				return
+			}
+			push(serviceKey, instances)
+		},
 	}
-	if err := ngc.grpcClient.Unsubscribe(param); err != nil {
-		NacosClientLogger.Error("service unsubscribe error " + serviceName)
+	if err := ngc.grpcClient.Subscribe(param); err != nil {
 		return err
 	}
 
-	defer ngc.SubscribeMap.DLock.Unlock()
-	ngc.SubscribeMap.DLock.Lock()
-	ngc.SubscribeMap.Data[serviceName] = false
-
+	ngc.paramsLock.Lock()
+	defer ngc.paramsLock.Unlock()
+	ngc.params[serviceKey] = param
 	return nil
 }
 
-func (ngc *NacosGrpcClient) Callback(instances []model.Instance, err error) {
-	//服务下线,更新实例数量为0
-	if len(instances) == 0 {
-		for serviceName, _ := range AllDoms.Data {
-			if service := ngc.GetService(serviceName); len(service.Hosts) == 0 {
-				ngc.nacosClient.GetDomainCache().Set(serviceName, service)
-				ngc.Unsubsrcibe(serviceName)
-			}
-		}
-		return
-	}
+func (ngc *NacosGrpcClient) Unsubscribe(serviceKey string) error {
+	ngc.paramsLock.Lock()
+	param, ok := ngc.params[serviceKey]
+	delete(ngc.params, serviceKey)
+	ngc.paramsLock.Unlock()
 
-	serviceName := strings.Split(instances[0].ServiceName, SEPERATOR)[1]
-	oldService, ok := ngc.nacosClient.GetDomainCache().Get(serviceName)
-	if !ok {
-		NacosClientLogger.Info("service not found in cache " + serviceName)
-		service := ngc.GetService(serviceName)
-		ngc.nacosClient.GetDomainCache().Set(serviceName, service)
-	} else {
-		service := oldService.(model.Service)
-		service.Hosts = instances
-		service.LastRefTime = uint64(CurrentMillis())
-		ngc.nacosClient.GetDomainCache().Set(serviceName, service)
+	if !ok || ngc.grpcClient == nil {
+		return nil
 	}
-	NacosClientLogger.Info("serviceName: "+serviceName+" was updated to: ", instances)
-
+	// the SDK tells callbacks apart by the address of the subscribed param
+	return ngc.grpcClient.Unsubscribe(param)
 }
 
-func (ngc *NacosGrpcClient) HasSubcribed(serviceName string) bool {
-	defer ngc.SubscribeMap.DLock.RUnlock()
-	ngc.SubscribeMap.DLock.RLock()
-	return ngc.SubscribeMap.Data[serviceName]
+// Close closes the naming client.
+func (ngc *NacosGrpcClient) Close() {
+	if ngc.grpcClient != nil {
+		ngc.grpcClient.CloseClient()
+	}
 }
@@ -1,186 +1,54 @@
 package nacos
 
 import (
-	"fmt"
 	"testing"
 
-	"github.com/nacos-group/nacos-sdk-go/v2/model"
 	"github.com/stretchr/testify/assert"
 )
 
-var grpcClientTest = NewNacosGrpcClientTest()
-
-func NewNacosGrpcClientTest() *NacosGrpcClient {
-	grpcClient, err := NewNacosGrpcClient("", []string{"console.nacos.io:8848"}, "", "", nacosClientTest)
-	if err != nil {
-		fmt.Println("init grpc client failed")
+func TestNewNacosGrpcClient(t *testing.T) {
+	grpcClient, err := NewNacosGrpcClient(NacosClientConfig{
+		NamespaceId: "public",
+		ServerHosts: []string{"127.0.0.1:8848"},
+		CachePath:   t.TempDir(),
+	})
+	if assert.NoError(t, err) {
+		defer grpcClient.Close()
 	}
-	return grpcClient
-}
-
-func TestGetAllServicesInfo(t *testing.T) {
-	services := grpcClientTest.GetAllServicesInfo()
-	if len(services) > 0 {
-		t.Log("GrpcClient get all servicesInfo passed")
-	} else {
-		t.Log("GrpcClient get all servicesInfo empty")
+	assert.Equal(t, "", grpcClient.namespaceId)
+	assert.Equal(t, []string{"DEFAULT_GROUP"}, grpcClient.groups)
+	if assert.Len(t, grpcClient.serverConfigs, 1) {
+		assert.Equal(t, uint64(8848), grpcClient.serverConfigs[0].Port)
 	}
-}
 
-func TestGetService(t *testing.T) {
-	services := grpcClientTest.GetAllServicesInfo()
-	serviceMap := NewConcurrentMap()
-	for _, serviceName := range services {
-		service := grpcClientTest.GetService(serviceName)
-		if assert.NotNil(t, service) {
-			serviceMap.Set(serviceName, service)
-		}
-	}
-	if serviceMap.Count() == len(services) {
-		t.Log("GrpcClient get service passed")
-	} else {
-		t.Error("GrpcClient get service error")
-	}
+	// unknown services are not unsubscribed from the server
+	assert.NoError(t, grpcClient.Unsubscribe("DEFAULT_GROUP@@demo.go"))
 }
 
-func TestSubscribe(t *testing.T) {
-	doms := grpcClientTest.GetAllServicesInfo()
-	for _, dom := range doms {
-		err := grpcClientTest.Subscribe(dom)
-		if err != nil {
-			t.Error("GrpcClient subscribe service error")
-			return
-		}
+func TestNacosGrpcClient_GetServiceMetadata(t *testing.T) {
+	// the gRPC API has no service metadata, it is read from the v1 API
+	server := newFakeNacosServer(testService("orders", "10.0.0.1"))
+	server.metadata["DEFAULT_GROUP@@orders"] = map[string]string{TTLMetadataKey: "45"}
+	defer server.Close()
+
+	grpcClient, err := NewNacosGrpcClient(NacosClientConfig{ServerHosts: []string{server.host()}, CachePath: t.TempDir()})
+	if assert.NoError(t, err) {
+		defer grpcClient.Close()
 	}
-	t.Log("GrpcClient subscribe service passed")
+	metadata, err := grpcClient.GetServiceMetadata("DEFAULT_GROUP@@orders")
+	assert.NoError(t, err)
+	assert.Equal(t, "45", metadata[TTLMetadataKey])
 }
 
-func TestCallback(t *testing.T) {
-	services := model.Service{
-		Name:        "DEFAULT_GROUP@@demo.go",
-		CacheMillis: 1000,
-		Hosts: []model.Instance{
-			{
-				InstanceId:  "10.10.10.10-80-a-DEMO",
-				Port:        80,
-				Ip:          "10.10.10.10",
-				Weight:      1,
-				Metadata:    map[string]string{},
-				ClusterName: "a",
-				ServiceName: "DEFAULT_GROUP@@demo.go",
-				Enable:      true,
-				Healthy:     true,
-			},
-			{
-				InstanceId:  "10.10.10.11-80-a-DEMO",
-				Port:        80,
-				Ip:          "10.10.10.11",
-				Weight:      1,
-				Metadata:    map[string]string{},
-				ClusterName: "a",
-				ServiceName: "DEFAULT_GROUP@@demo.go",
-				Enable:      true,
-				Healthy:     true,
-			},
-			{
-				InstanceId:  "10.10.10.12-80-a-DEMO",
-				Port:        80,
-				Ip:          "10.10.10.12",
-				Weight:      1,
-				Metadata:    map[string]string{},
-				ClusterName: "a",
-				ServiceName: "DEFAULT_GROUP@@demo.go",
-				Enable:      true,
-				Healthy:     false,
-			},
-			{
-				InstanceId:  "10.10.10.13-80-a-DEMO",
-				Port:        80,
-				Ip:          "10.10.10.13",
-				Weight:      1,
-				Metadata:    map[string]string{},
-				ClusterName: "a",
-				ServiceName: "DEFAULT_GROUP@@demo.go",
-				Enable:      false,
-				Healthy:     true,
-			},
-			{
-				InstanceId:  "10.10.10.14-80-a-DEMO",
-				Port:        80,
-				Ip:          "10.10.10.14",
-				Weight:      0,
-				Metadata:    map[string]string{},
-				ClusterName: "a",
-				ServiceName: "DEFAULT_GROUP@@demo.go",
-				Enable:      true,
-				Healthy:     true,
-			},
-		},
-		Checksum:    "3bbcf6dd1175203a8afdade0e77a27cd1528787794594",
-		LastRefTime: 1528787794594, Clusters: "a"}
-
-	grpcClientTest.nacosClient.GetDomainCache().Set("demo.go", services)
-
-	newServices := model.Service{
-		Name:        "DEFAULT_GROUP@@demo.go",
-		CacheMillis: 1000,
-		Hosts: []model.Instance{
-			{
-				InstanceId:  "10.10.10.10-80-a-DEMO",
-				Port:        80,
-				Ip:          "10.10.10.10",
-				Weight:      1,
-				Metadata:    map[string]string{},
-				ClusterName: "a",
-				ServiceName: "DEFAULT_GROUP@@demo.go",
-				Enable:      true,
-				Healthy:     true,
-			},
-			{
-				InstanceId:  "10.10.10.11-80-a-DEMO",
-				Port:        80,
-				Ip:          "10.10.10.11",
-				Weight:      1,
-				Metadata:    map[string]string{},
-				ClusterName: "a",
-				ServiceName: "DEFAULT_GROUP@@demo.go",
-				Enable:      true,
-				Healthy:     true,
-			},
-			{
-				InstanceId:  "10.10.10.12-80-a-DEMO",
-				Port:        80,
-				Ip:          "10.10.10.12",
-				Weight:      1,
-				Metadata:    map[string]string{},
-				ClusterName: "a",
-				ServiceName: "DEFAULT_GROUP@@demo.go",
-				Enable:      true,
-				Healthy:     false,
-			},
-			{
-				InstanceId:  "10.10.10.13-80-a-DEMO",
-				Port:        80,
-				Ip:          "10.10.10.13",
-				Weight:      1,
-				Metadata:    map[string]string{},
-				ClusterName: "a",
-				ServiceName: "DEFAULT_GROUP@@demo.go",
-				Enable:      false,
-				Healthy:     true,
-			},
-		},
-		Checksum:    "3bbcf6dd1175203a8afdade0e77a27cd1528787794594",
-		LastRefTime: 1528787794594, Clusters: "a"}
-	grpcClientTest.Callback(newServices.Hosts, nil)
+func TestServiceKey(t *testing.T) {
+	assert.Equal(t, "DEFAULT_GROUP@@demo.go", ServiceKey("demo.go", ""))
+	assert.Equal(t, "PAYMENT_GROUP@@orders", ServiceKey("orders", "PAYMENT_GROUP"))
 
-	s, _ := grpcClientTest.nacosClient.GetDomainCache().Get("demo.go")
+	serviceName, groupName := SplitServiceKey("PAYMENT_GROUP@@orders")
+	assert.Equal(t, "orders", serviceName)
+	assert.Equal(t, "PAYMENT_GROUP", groupName)
 
-	updateServices := s.(model.Service)
-
-	if len(newServices.Hosts) == len(updateServices.Hosts) {
-		t.Log("GrpcClient Service SubscribeCallback passed")
-	} else {
-		t.Error("GrpcClient Service SubscribeCallback error")
-	}
+	serviceName, groupName = SplitServiceKey("demo.go")
+	assert.Equal(t, "demo.go", serviceName)
+	assert.Equal(t, "DEFAULT_GROUP", groupName)
 }
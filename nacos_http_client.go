@@ -0,0 +1,366 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/nacos-group/nacos-sdk-go/v2/common/constant"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+)
+
+const (
+	ProtocolGrpc = "grpc"
+	ProtocolHttp = "http"
+)
+
+// NacosHttpClient is the NamingBackend of the Nacos v1 Open API, for Nacos 1.x
+// or servers only reachable over HTTP. Services are polled, changes in between
+// are pushed over UDP to the port advertised when listing instances.
+type NacosHttpClient struct {
+	namespaceId string
+	servers     []string //http://host:port/nacos
+	hosts       []string // servers 的主机名, 推送只接受来自这些主机
+	username    string
+	password    string
+	accessKey   string
+	secretKey   string
+	groups      []string
+	httpClient  *http.Client
+
+	tokenLock   sync.Mutex
+	accessToken string
+	tokenExpire time.Time
+
+	pushLock  sync.Mutex
+	pushes    map[string]PushFunc
+	udpServer *UDPServer
+	cancel    context.CancelFunc
+	serving   sync.WaitGroup
+}
+
+type accessToken struct {
+	AccessToken string `json:"accessToken"`
+	TokenTtl    int64  `json:"tokenTtl"`
+}
+
+func NewNacosHttpClient(config NacosClientConfig) (*NacosHttpClient, error) {
+	hc := NacosHttpClient{
+		namespaceId: config.NamespaceId,
+		username:    config.Username,
+		password:    config.Password,
+		accessKey:   config.AccessKey,
+		secretKey:   config.SecretKey,
+		groups:      config.Groups,
+		httpClient:  &http.Client{Timeout: 5 * time.Second},
+		pushes:      make(map[string]PushFunc),
+	}
+	if hc.namespaceId == "public" {
+		hc.namespaceId = ""
+	}
+	if len(hc.groups) == 0 {
+		hc.groups = []string{constant.DEFAULT_GROUP}
+	}
+	for _, serverHost := range config.ServerHosts {
+		host, port, err := parseServerHost(serverHost)
+		if err != nil {
+			return &hc, err
+		}
+		hc.hosts = append(hc.hosts, host)
+		hc.servers = append(hc.servers, config.scheme()+"://"+net.JoinHostPort(host, strconv.FormatUint(port, 10))+config.contextPath())
+	}
+	if config.TLS.Enable {
+		tlsConfig, err := config.tlsConfig()
+		if err != nil {
+			return &hc, err
+		}
+		hc.httpClient.Transport = pkgtls.NewHTTPSTransport(tlsConfig)
+	}
+	return &hc, nil
+}
+
+// ListServices lists the services of every configured group, returning their
+// group qualified names.
+func (hc *NacosHttpClient) ListServices() ([]string, error) {
+	var services []string
+	for _, group := range hc.groups {
+		serviceNames, err := hc.getGroupServices(group)
+		if err != nil {
+			return nil, err
+		}
+		for _, serviceName := range serviceNames {
+			services = append(services, ServiceKey(serviceName, group))
+		}
+	}
+	return services, nil
+}
+
+func (hc *NacosHttpClient) getGroupServices(group string) ([]string, error) {
+	var pageSize = 100
+	var services []string
+
+	// 如果当前页数服务数满了, 继续查找添加下一页
+	for pageNo := 1; ; pageNo++ {
+		var page model.ServiceList
+		err := hc.get("/v1/ns/service/list", url.Values{
+			"groupName": {group},
+			"pageNo":    {strconv.Itoa(pageNo)},
+			"pageSize":  {strconv.Itoa(pageSize)},
+		}, &page)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, page.Doms...)
+		if len(page.Doms) < pageSize {
+			return services, nil
+		}
+	}
+}
+
+// GetService lists the instances of a service, registering this client for
+// pushes of its changes.
+func (hc *NacosHttpClient) GetService(serviceKey string) (model.Service, error) {
+	serviceName, groupName := SplitServiceKey(serviceKey)
+	params := url.Values{
+		"serviceName": {serviceName},
+		"groupName":   {groupName},
+		"healthyOnly": {"false"},
+	}
+	if port := hc.pushPort(); port > 0 {
+		params.Set("udpPort", strconv.Itoa(port))
+		params.Set("clientIP", LocalIP())
+	}
+
+	var service model.Service
+	err := hc.get("/v1/ns/instance/list", params, &service)
+	return service, err
+}
+
+// GetServiceMetadata reads the metadata of a service from /v1/ns/service.
+func (hc *NacosHttpClient) GetServiceMetadata(serviceKey string) (map[string]string, error) {
+	serviceName, groupName := SplitServiceKey(serviceKey)
+	var service model.ServiceInfo
+	err := hc.get("/v1/ns/service", url.Values{
+		"serviceName": {serviceName},
+		"groupName":   {groupName},
+	}, &service)
+	return service.Metadata, err
+}
+
+// Subscribe starts the UDP push receiver on first use. Nacos pushes to clients
+// that listed the instances of a service recently, which asyncUpdateDomain does.
+func (hc *NacosHttpClient) Subscribe(serviceKey string, push PushFunc) error {
+	hc.pushLock.Lock()
+	defer hc.pushLock.Unlock()
+
+	if hc.udpServer == nil && EnableReceivePush {
+		us := &UDPServer{receive: hc.receive, allow: hc.serverIPs()}
+		if us.Listen() {
+			ctx, cancel := context.WithCancel(context.Background())
+			hc.udpServer, hc.cancel = us, cancel
+			hc.serving.Add(1)
+			go func() {
+				defer hc.serving.Done()
+				us.Serve(ctx)
+			}()
+		}
+	}
+	hc.pushes[serviceKey] = push
+	return nil
+}
+
+func (hc *NacosHttpClient) Unsubscribe(serviceKey string) error {
+	hc.pushLock.Lock()
+	defer hc.pushLock.Unlock()
+	delete(hc.pushes, serviceKey)
+	return nil
+}
+
+// Close stops the UDP push receiver.
+func (hc *NacosHttpClient) Close() {
+	hc.pushLock.Lock()
+	if hc.cancel != nil {
+		hc.cancel()
+	}
+	hc.pushLock.Unlock()
+	hc.serving.Wait()
+}
+
+func (hc *NacosHttpClient) pushPort() int {
+	hc.pushLock.Lock()
+	defer hc.pushLock.Unlock()
+	if hc.udpServer == nil {
+		return 0
+	}
+	return hc.udpServer.Port()
+}
+
+// serverIPs resolves the hosts of the servers, returning whether a push comes
+// from one of them.
+func (hc *NacosHttpClient) serverIPs() func(ip net.IP) bool {
+	var ips []net.IP
+	for _, host := range hc.hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		resolved, err := net.LookupIP(host)
+		if err != nil {
+			log.Warningf("Failed to resolve nacos server %s, ignoring its pushes: %s", host, err)
+			continue
+		}
+		ips = append(ips, resolved...)
+	}
+	return func(ip net.IP) bool {
+		for _, serverIP := range ips {
+			if serverIP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// receive hands a pushed service to its subscriber. Nacos 1.x pushes group
+// qualified names.
+func (hc *NacosHttpClient) receive(service model.Service) {
+	serviceKey := ServiceKey(SplitServiceKey(service.Name))
+	hc.pushLock.Lock()
+	push := hc.pushes[serviceKey]
+	hc.pushLock.Unlock()
+
+	if push != nil {
+		push(serviceKey, service.Hosts)
+	}
+}
+
+// get decodes the JSON response of the first server answering path, starting
+// from a random one.
+func (hc *NacosHttpClient) get(path string, params url.Values, v interface{}) error {
+	if len(hc.servers) == 0 {
+		return NacosClientError{"no nacos server configured"}
+	}
+
+	token, err := hc.token()
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		params.Set("accessToken", token)
+	}
+	hc.sign(params)
+	params.Set("namespaceId", hc.namespaceId)
+
+	start := rand.Intn(len(hc.servers))
+	for i := range hc.servers {
+		server := hc.servers[(start+i)%len(hc.servers)]
+		var body []byte
+		body, err = hc.do(http.MethodGet, server+path+"?"+params.Encode(), nil)
+		if err != nil {
+			log.Warningf("Failed to request %s%s: %s", server, path, err)
+			continue
+		}
+		return json.Unmarshal(body, v)
+	}
+	return err
+}
+
+// sign adds the AccessKey signature Alibaba Cloud MSE expects, of the time and
+// the group qualified service name if there is one.
+func (hc *NacosHttpClient) sign(params url.Values) {
+	if hc.accessKey == "" {
+		return
+	}
+
+	data := strconv.FormatInt(CurrentMillis(), 10)
+	if serviceName := params.Get("serviceName"); serviceName != "" {
+		data += SEPERATOR + ServiceKey(serviceName, params.Get("groupName"))
+	}
+	mac := hmac.New(sha1.New, []byte(hc.secretKey))
+	mac.Write([]byte(data))
+	params.Set("ak", hc.accessKey)
+	params.Set("data", data)
+	params.Set("signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// token logs in when a username is configured and returns the access token
+// until it is about to expire.
+func (hc *NacosHttpClient) token() (string, error) {
+	if hc.username == "" {
+		return "", nil
+	}
+
+	hc.tokenLock.Lock()
+	defer hc.tokenLock.Unlock()
+	if hc.accessToken != "" && time.Now().Before(hc.tokenExpire) {
+		return hc.accessToken, nil
+	}
+
+	form := url.Values{"username": {hc.username}, "password": {hc.password}}
+	var err error
+	for _, server := range hc.servers {
+		var body []byte
+		body, err = hc.do(http.MethodPost, server+"/v1/auth/login", form)
+		if err != nil {
+			continue
+		}
+		var token accessToken
+		if err = json.Unmarshal(body, &token); err != nil {
+			continue
+		}
+		hc.accessToken = token.AccessToken
+		// refresh at 90% of the ttl
+		hc.tokenExpire = time.Now().Add(time.Duration(token.TokenTtl) * time.Second * 9 / 10)
+		return hc.accessToken, nil
+	}
+	return "", err
+}
+
+func (hc *NacosHttpClient) do(method, rawURL string, form url.Values) ([]byte, error) {
+	var resp *http.Response
+	var err error
+	if form != nil {
+		resp, err = hc.httpClient.PostForm(rawURL, form)
+	} else {
+		resp, err = hc.httpClient.Get(rawURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, NacosClientError{fmt.Sprintf("%s %s: %d %s", method, strings.Split(rawURL, "?")[0], resp.StatusCode, body)}
+	}
+	return body, nil
+}
@@ -0,0 +1,365 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nacos-group/nacos-sdk-go/v2/common/constant"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNacosServer is a stand-in for the v1 Open API of a Nacos server.
+type fakeNacosServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	services map[string]model.Service // by group qualified name
+	metadata map[string]map[string]string
+	logins   int
+	udpPort  string
+	queries  []string
+	// secretKey, when set, requires requests signed by accessKey
+	accessKey string
+	secretKey string
+}
+
+func newFakeNacosServer(services ...model.Service) *fakeNacosServer {
+	s := newUnstartedFakeNacosServer(services...)
+	s.Start()
+	return s
+}
+
+// newFakeNacosTLSServer requires a client certificate. Its own certificate is
+// valid for 127.0.0.1 and example.com.
+func newFakeNacosTLSServer(services ...model.Service) *fakeNacosServer {
+	s := newUnstartedFakeNacosServer(services...)
+	s.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	s.StartTLS()
+	return s
+}
+
+func newUnstartedFakeNacosServer(services ...model.Service) *fakeNacosServer {
+	s := &fakeNacosServer{services: make(map[string]model.Service), metadata: make(map[string]map[string]string)}
+	for _, service := range services {
+		s.services[ServiceKey(service.Name, service.GroupName)] = service
+	}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *fakeNacosServer) host() string {
+	return s.Listener.Addr().String()
+}
+
+// writeTestCerts writes the CA bundle verifying server and a self-signed
+// client certificate and key to dir.
+func writeTestCerts(t *testing.T, server *httptest.Server) (caFile, certFile, keyFile string) {
+	dir := t.TempDir()
+	caFile, certFile, keyFile = filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	writePEM(t, caFile, "CERTIFICATE", server.Certificate().Raw)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "coredns"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(key)
+	writePEM(t, certFile, "CERTIFICATE", cert)
+	writePEM(t, keyFile, "EC PRIVATE KEY", der)
+	return caFile, certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *fakeNacosServer) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queries = append(s.queries, req.URL.RawQuery)
+
+	query := req.URL.Query()
+	if s.TLS != nil && (req.TLS == nil || len(req.TLS.PeerCertificates) == 0) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if s.secretKey != "" {
+		mac := hmac.New(sha1.New, []byte(s.secretKey))
+		mac.Write([]byte(query.Get("data")))
+		if query.Get("ak") != s.accessKey || query.Get("signature") != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if query.Get("serviceName") != "" && !strings.HasSuffix(query.Get("data"), "@@"+query.Get("groupName")+"@@"+query.Get("serviceName")) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	switch req.URL.Path {
+	case "/nacos/v1/auth/login":
+		s.logins++
+		if req.FormValue("username") != "nacos" || req.FormValue("password") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(accessToken{AccessToken: "token", TokenTtl: 18000})
+		return
+	case "/nacos/v1/ns/service/list":
+		pageNo, _ := strconv.Atoi(query.Get("pageNo"))
+		pageSize, _ := strconv.Atoi(query.Get("pageSize"))
+		var names []string
+		for key := range s.services {
+			if serviceName, groupName := SplitServiceKey(key); groupName == query.Get("groupName") {
+				names = append(names, serviceName)
+			}
+		}
+		sort.Strings(names)
+		page := model.ServiceList{Count: int64(len(names)), Doms: []string{}}
+		for i := (pageNo - 1) * pageSize; i < len(names) && i < pageNo*pageSize; i++ {
+			page.Doms = append(page.Doms, names[i])
+		}
+		json.NewEncoder(w).Encode(page)
+	case "/nacos/v1/ns/instance/list":
+		s.udpPort = query.Get("udpPort")
+		service, ok := s.services[ServiceKey(query.Get("serviceName"), query.Get("groupName"))]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(service)
+	case "/nacos/v1/ns/service":
+		key := ServiceKey(query.Get("serviceName"), query.Get("groupName"))
+		if _, ok := s.services[key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(model.ServiceInfo{Name: query.Get("serviceName"), Group: query.Get("groupName"), Metadata: s.metadata[key]})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestNacosHttpClient_ListServices(t *testing.T) {
+	var services []model.Service
+	for i := 0; i < 150; i++ {
+		services = append(services, testService(fmt.Sprintf("service-%d", i), "10.0.0.1"))
+	}
+	services = append(services, testGroupService("orders", "PAYMENT_GROUP", "10.0.1.1"))
+	server := newFakeNacosServer(services...)
+	defer server.Close()
+
+	hc, _ := NewNacosHttpClient(NacosClientConfig{NamespaceId: "dev", ServerHosts: []string{server.host()}, Groups: []string{"DEFAULT_GROUP", "PAYMENT_GROUP"}})
+	keys, err := hc.ListServices()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 151)
+	assert.Contains(t, keys, "PAYMENT_GROUP@@orders")
+	assert.Contains(t, keys, "DEFAULT_GROUP@@service-149")
+	assert.Contains(t, server.queries[0], "namespaceId=dev")
+}
+
+func TestNacosHttpClient_GetService(t *testing.T) {
+	server := newFakeNacosServer(testGroupService("orders", "PAYMENT_GROUP", "10.0.1.1", "10.0.1.2"))
+	defer server.Close()
+	// the first server is down
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	hc, _ := NewNacosHttpClient(NacosClientConfig{
+		ServerHosts: []string{strings.TrimPrefix(down.URL, "http://"), server.host()},
+		Username:    "nacos",
+		Password:    "secret",
+	})
+	for i := 0; i < 3; i++ {
+		service, err := hc.GetService("PAYMENT_GROUP@@orders")
+		assert.NoError(t, err)
+		assert.Len(t, service.Hosts, 2)
+	}
+	assert.Equal(t, 1, server.logins)
+	assert.Contains(t, server.queries[len(server.queries)-1], "accessToken=token")
+
+	_, err := hc.GetService("PAYMENT_GROUP@@unknown")
+	assert.Error(t, err)
+
+	hc.password = "wrong"
+	hc.accessToken = ""
+	_, err = hc.GetService("PAYMENT_GROUP@@orders")
+	assert.Error(t, err)
+}
+
+func TestNacosHttpClient_GetServiceMetadata(t *testing.T) {
+	server := newFakeNacosServer(testGroupService("orders", "PAYMENT_GROUP", "10.0.1.1"))
+	server.metadata["PAYMENT_GROUP@@orders"] = map[string]string{TTLMetadataKey: "45"}
+	defer server.Close()
+
+	hc, _ := NewNacosHttpClient(NacosClientConfig{NamespaceId: "dev", ServerHosts: []string{server.host()}})
+	metadata, err := hc.GetServiceMetadata("PAYMENT_GROUP@@orders")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{TTLMetadataKey: "45"}, metadata)
+	assert.Contains(t, server.queries[0], "namespaceId=dev")
+
+	_, err = hc.GetServiceMetadata("PAYMENT_GROUP@@unknown")
+	assert.Error(t, err)
+}
+
+func TestNacosHttpClient_AccessKey(t *testing.T) {
+	server := newFakeNacosServer(testService("orders", "10.0.0.1"))
+	server.accessKey, server.secretKey = "ak", "sk"
+	defer server.Close()
+
+	hc, _ := NewNacosHttpClient(NacosClientConfig{ServerHosts: []string{server.host()}, AccessKey: "ak", SecretKey: "sk"})
+	_, err := hc.ListServices()
+	assert.NoError(t, err)
+	service, err := hc.GetService("DEFAULT_GROUP@@orders")
+	assert.NoError(t, err)
+	assert.Len(t, service.Hosts, 1)
+
+	hc.secretKey = "wrong"
+	_, err = hc.GetService("DEFAULT_GROUP@@orders")
+	assert.Error(t, err)
+}
+
+func TestNacosHttpClient_TLS(t *testing.T) {
+	server := newFakeNacosTLSServer(testService("orders", "10.0.0.1"))
+	defer server.Close()
+	caFile, certFile, keyFile := writeTestCerts(t, server.Server)
+
+	tests := []struct {
+		name    string
+		tls     constant.TLSConfig
+		success bool
+	}{
+		{"ca and client cert", constant.TLSConfig{Enable: true, CaFile: caFile, CertFile: certFile, KeyFile: keyFile}, true},
+		{"server name", constant.TLSConfig{Enable: true, CaFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerNameOverride: "example.com"}, true},
+		{"wrong server name", constant.TLSConfig{Enable: true, CaFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerNameOverride: "nacos.internal"}, false},
+		{"system roots", constant.TLSConfig{Enable: true, CertFile: certFile, KeyFile: keyFile}, false},
+		{"no client cert", constant.TLSConfig{Enable: true, CaFile: caFile}, false},
+	}
+
+	for _, tc := range tests {
+		hc, err := NewNacosHttpClient(NacosClientConfig{ServerHosts: []string{server.host()}, TLS: tc.tls})
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, "https://"+server.host()+"/nacos", hc.servers[0], tc.name)
+
+		service, err := hc.GetService("DEFAULT_GROUP@@orders")
+		if tc.success {
+			assert.NoError(t, err, tc.name)
+			assert.Len(t, service.Hosts, 1, tc.name)
+		} else {
+			assert.Error(t, err, tc.name)
+		}
+	}
+
+	_, err := NewNacosHttpClient(NacosClientConfig{TLS: constant.TLSConfig{Enable: true, CaFile: keyFile}})
+	assert.Error(t, err)
+}
+
+func TestNacosHttpClient_Push(t *testing.T) {
+	server := newFakeNacosServer(testService("orders", "10.0.0.1"))
+	defer server.Close()
+
+	hc, _ := NewNacosHttpClient(NacosClientConfig{ServerHosts: []string{server.host()}})
+	pushed := make(chan []model.Instance, 1)
+	assert.NoError(t, hc.Subscribe("DEFAULT_GROUP@@orders", func(serviceKey string, instances []model.Instance) {
+		pushed <- instances
+	}))
+	defer hc.Close()
+
+	// listing the instances advertises the push port
+	_, err := hc.GetService("DEFAULT_GROUP@@orders")
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(hc.pushPort()), server.udpPort)
+
+	data, _ := json.Marshal(testService("DEFAULT_GROUP@@orders", "10.0.0.1", "10.0.0.2"))
+	push, _ := json.Marshal(PushData{PushType: "dom", Data: string(data), LastRefTime: CurrentMillis()})
+	conn, err := net.Dial("udp", "127.0.0.1:"+server.udpPort)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		conn.Write(push)
+	}
+
+	select {
+	case instances := <-pushed:
+		assert.Len(t, instances, 2)
+	case <-time.After(3 * time.Second):
+		t.Error("push was not received")
+	}
+}
+
+func TestNacosHttpClient_ServerIPs(t *testing.T) {
+	hc, err := NewNacosHttpClient(NacosClientConfig{ServerHosts: []string{"10.0.0.1:8848", "[fd00::1]:8848", "localhost:8848"}})
+	assert.NoError(t, err)
+	allow := hc.serverIPs()
+	assert.True(t, allow(net.ParseIP("10.0.0.1")))
+	assert.True(t, allow(net.ParseIP("fd00::1")))
+	assert.True(t, allow(net.ParseIP("127.0.0.1")))
+	assert.False(t, allow(net.ParseIP("10.0.0.2")))
+	assert.False(t, allow(net.ParseIP("192.168.1.1")))
+}
+
+func TestNacosHttpClient_Resolve(t *testing.T) {
+	server := newFakeNacosServer(testService("orders", "10.0.0.1"))
+	defer server.Close()
+
+	vc := NewNacosClient(NacosClientConfig{
+		ServerHosts: []string{server.host()},
+		Protocol:    ProtocolHttp,
+		CachePath:   t.TempDir(),
+	})
+	vc.Start()
+	defer vc.Stop()
+
+	vs := &Nacos{Zones: []string{"svc.local."}, NacosClientImpl: vc, SOA: DefaultSOAConfig(), TTL: DefaultTTL}
+	_, resp := serve(t, vs, "orders.svc.local.", dns.TypeA)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "10.0.0.1", resp.Answer[0].(*dns.A).A.String())
+	}
+}
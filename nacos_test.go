@@ -0,0 +1,691 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestNacos returns a handler whose client already knows and has
+// subscribed to services of a fakeBackend.
+// Responses are not cached unless DNSCache is set.
+func newTestNacos(zones []string, services ...model.Service) *Nacos {
+	vc := newNacosClient(NacosClientConfig{}, newFakeBackend(services...))
+	for _, service := range services {
+		key := ServiceKey(service.Name, service.GroupName)
+		vc.allDoms.Data[key] = true
+		vc.serviceMap.Set(key, service)
+		vc.Subscribe(key)
+	}
+
+	return &Nacos{
+		Next:            test.NextHandler(dns.RcodeRefused, nil),
+		Zones:           zones,
+		NacosClientImpl: vc,
+		SOA:             DefaultSOAConfig(),
+		TTL:             DefaultTTL,
+	}
+}
+
+func testService(name string, ips ...string) model.Service {
+	return testGroupService(name, "DEFAULT_GROUP", ips...)
+}
+
+func testGroupService(name, group string, ips ...string) model.Service {
+	service := model.Service{Name: name, GroupName: group, CacheMillis: 1000}
+	for _, ip := range ips {
+		service.Hosts = append(service.Hosts, model.Instance{
+			Ip:          ip,
+			Port:        80,
+			Weight:      1,
+			Healthy:     true,
+			Enable:      true,
+			ServiceName: ServiceKey(name, group),
+		})
+	}
+	return service
+}
+
+func serve(t *testing.T, vs *Nacos, qname string, qtype uint16) (int, *dns.Msg) {
+	return serveWith(t, vs, &test.ResponseWriter{}, qname, qtype)
+}
+
+func serveWith(t *testing.T, vs *Nacos, w dns.ResponseWriter, qname string, qtype uint16) (int, *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(qname), qtype)
+	rec := dnstest.NewRecorder(w)
+	code, err := vs.ServeDNS(context.TODO(), rec, m)
+	assert.NoError(t, err)
+	return code, rec.Msg
+}
+
+func TestServiceName(t *testing.T) {
+	tests := []struct {
+		qname, zone, expected string
+	}{
+		{"orders.svc.example.internal.", "svc.example.internal.", "orders"},
+		{"Orders.SVC.example.internal.", "svc.example.internal.", "Orders"},
+		{"demo.go.svc.example.internal.", "svc.example.internal.", "demo.go"},
+		{"svc.example.internal.", "svc.example.internal.", ""},
+		{"demo.go.", ".", "demo.go"},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.expected, serviceName(tc.qname, tc.zone), tc.qname)
+	}
+}
+
+func TestNacos_ServeDNSZones(t *testing.T) {
+	vs := newTestNacos([]string{"svc.example.internal."}, testService("orders", "10.0.0.1"))
+
+	code, resp := serve(t, vs, "orders.svc.example.internal.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, code)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "orders.svc.example.internal.", resp.Answer[0].Header().Name)
+		assert.Equal(t, "10.0.0.1", resp.Answer[0].(*dns.A).A.String())
+	}
+
+	// the bare service name lies outside the configured zone
+	code, resp = serve(t, vs, "orders.", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, code)
+	assert.Nil(t, resp)
+
+	// names in the zone which are not Nacos services do not exist
+	code, resp = serve(t, vs, "billing.svc.example.internal.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, code)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	// unless the zone is the root, which leaves them to the next plugin
+	vs.Zones = []string{"."}
+	code, resp = serve(t, vs, "billing.", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, code)
+	assert.Nil(t, resp)
+}
+
+func TestNacos_ServeDNSGroups(t *testing.T) {
+	vs := newTestNacos([]string{"svc.local."},
+		testService("orders", "10.0.0.1"),
+		testGroupService("orders", "PAYMENT_GROUP", "10.0.1.1"),
+		testGroupService("demo.go", "PAYMENT_GROUP", "10.0.1.2"))
+	vs.Groups = []string{"DEFAULT_GROUP", "PAYMENT_GROUP"}
+	vs.NamingScheme = SchemeServiceGroup
+
+	tests := []struct {
+		qname    string
+		expected string
+	}{
+		{"orders.svc.local.", "10.0.0.1"},
+		{"orders.default_group.svc.local.", "10.0.0.1"},
+		{"orders.payment_group.svc.local.", "10.0.1.1"},
+		{"demo.go.PAYMENT_GROUP.svc.local.", "10.0.1.2"},
+	}
+
+	for _, tc := range tests {
+		code, resp := serve(t, vs, tc.qname, dns.TypeA)
+		assert.Equal(t, dns.RcodeSuccess, code, tc.qname)
+		if assert.Len(t, resp.Answer, 1, tc.qname) {
+			assert.Equal(t, tc.expected, resp.Answer[0].(*dns.A).A.String(), tc.qname)
+		}
+	}
+
+	// group labels exist above their services, RFC 8020
+	for _, qname := range []string{"payment_group.svc.local.", "_tcp.payment_group.svc.local.", "default_group.svc.local."} {
+		code, resp := serve(t, vs, qname, dns.TypeA)
+		assert.Equal(t, dns.RcodeSuccess, code, qname)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode, qname)
+		assert.Empty(t, resp.Answer, qname)
+		assert.Len(t, resp.Ns, 1, qname)
+	}
+	_, resp := serve(t, vs, "other_group.svc.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	// the default scheme does not interpret group labels
+	vs.NamingScheme = SchemeService
+	_, resp = serve(t, vs, "orders.payment_group.svc.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	_, resp = serve(t, vs, "payment_group.svc.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	// the default group is configurable
+	vs.Groups = []string{"PAYMENT_GROUP"}
+	code, resp := serve(t, vs, "orders.svc.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, code)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "10.0.1.1", resp.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestNacos_ServeDNSClusters(t *testing.T) {
+	service := testService("orders", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	service.Hosts[0].ClusterName = "hz-a"
+	service.Hosts[1].ClusterName = "hz-b"
+	service.Hosts[2].ClusterName = "DEFAULT"
+	vs := newTestNacos([]string{"svc.local."}, service)
+
+	answers := func(qname string) []string {
+		code, resp := serve(t, vs, qname, dns.TypeA)
+		assert.Equal(t, dns.RcodeSuccess, code, qname)
+		var ips []string
+		for _, rr := range resp.Answer {
+			ips = append(ips, rr.(*dns.A).A.String())
+		}
+		return ips
+	}
+
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, answers("orders.svc.local."))
+	assert.Equal(t, []string{"10.0.0.1"}, answers("hz-a.orders.svc.local."))
+	assert.Equal(t, []string{"10.0.0.3"}, answers("default.orders.svc.local."))
+
+	// the clusters directive restricts names without a cluster label only
+	vs.Clusters = []string{"hz-a", "hz-b"}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, answers("orders.svc.local."))
+	assert.Equal(t, []string{"10.0.0.3"}, answers("DEFAULT.orders.svc.local."))
+
+	_, resp := serve(t, vs, "hz-a.billing.svc.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	// labels naming no cluster of the service do not exist
+	for _, qname := range []string{"typo.orders.svc.local.", "anything.orders.svc.local.", "a.b.orders.svc.local."} {
+		_, resp = serve(t, vs, qname, dns.TypeA)
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode, qname)
+	}
+
+	// a cluster of the clusters directive exists without instances
+	vs.Clusters = []string{"hz-a", "hz-c"}
+	assert.Empty(t, answers("hz-c.orders.svc.local."))
+}
+
+func TestSrvWeight(t *testing.T) {
+	tests := []struct {
+		weight   float64
+		expected uint16
+	}{
+		{1, 100},
+		{0.1, 10},
+		{0.25, 25},
+		{2.5, 250},
+		{0.001, 1},
+		{655.35, 65535},
+		{1000, 65535},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, srvWeight(test.weight), "weight %v", test.weight)
+	}
+}
+
+func TestNacos_ServeDNSSRV(t *testing.T) {
+	service := testService("orders", "10.0.0.1", "fd00::1", "10.0.0.3")
+	service.Hosts[0].Weight = 2.5
+	service.Hosts[1].Port = 8080
+	service.Hosts[2].Metadata = map[string]string{"protocol": "udp"}
+	vs := newTestNacos([]string{"svc.local."}, service)
+
+	code, resp := serve(t, vs, "_orders._tcp.svc.local.", dns.TypeSRV)
+	assert.Equal(t, dns.RcodeSuccess, code)
+	if assert.Len(t, resp.Answer, 2) && assert.Len(t, resp.Extra, 2) {
+		srv := resp.Answer[0].(*dns.SRV)
+		assert.Equal(t, "_orders._tcp.svc.local.", srv.Hdr.Name)
+		assert.Equal(t, "10-0-0-1.orders.svc.local.", srv.Target)
+		assert.Equal(t, uint16(250), srv.Weight)
+		assert.Equal(t, uint16(80), srv.Port)
+
+		srv = resp.Answer[1].(*dns.SRV)
+		assert.Equal(t, "fd00--1.orders.svc.local.", srv.Target)
+		assert.Equal(t, uint16(8080), srv.Port)
+
+		assert.Equal(t, "10-0-0-1.orders.svc.local.", resp.Extra[0].Header().Name)
+		assert.Equal(t, "10.0.0.1", resp.Extra[0].(*dns.A).A.String())
+		assert.Equal(t, "fd00--1.orders.svc.local.", resp.Extra[1].Header().Name)
+		assert.Equal(t, "fd00::1", resp.Extra[1].(*dns.AAAA).AAAA.String())
+	}
+
+	code, resp = serve(t, vs, "_orders._udp.svc.local.", dns.TypeSRV)
+	assert.Equal(t, dns.RcodeSuccess, code)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "10-0-0-3.orders.svc.local.", resp.Answer[0].(*dns.SRV).Target)
+	}
+
+	// SRV targets resolve to their instance
+	code, resp = serve(t, vs, "10-0-0-1.orders.svc.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, code)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "10.0.0.1", resp.Answer[0].(*dns.A).A.String())
+	}
+
+	// address answers no longer carry SRV records
+	_, resp = serve(t, vs, "orders.svc.local.", dns.TypeA)
+	assert.Empty(t, resp.Extra)
+
+	// fractional weights keep their share next to whole ones
+	canary := testService("canary", "10.0.1.1", "10.0.1.2")
+	canary.Hosts[0].Weight = 0.1
+	vs.NacosClientImpl.allDoms.Data["DEFAULT_GROUP@@canary"] = true
+	vs.NacosClientImpl.serviceMap.Set("DEFAULT_GROUP@@canary", canary)
+	_, resp = serve(t, vs, "_canary._tcp.svc.local.", dns.TypeSRV)
+	if assert.Len(t, resp.Answer, 2) {
+		assert.Equal(t, uint16(10), resp.Answer[0].(*dns.SRV).Weight)
+		assert.Equal(t, uint16(100), resp.Answer[1].(*dns.SRV).Weight)
+	}
+
+	_, resp = serve(t, vs, "_billing._tcp.svc.local.", dns.TypeSRV)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+}
+
+func TestNacos_ServeDNSNegative(t *testing.T) {
+	vs := newTestNacos([]string{"svc.local."}, testService("orders", "10.0.0.1"), testService("billing"), testService("demo.go", "10.0.0.2"))
+	vs.NacosClientImpl.lastPushMillis = 1700000000000
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+	}{
+		{"unknown.svc.local.", dns.TypeA, dns.RcodeNameError},
+		{"billing.svc.local.", dns.TypeA, dns.RcodeSuccess},
+		{"orders.svc.local.", dns.TypeTXT, dns.RcodeSuccess},
+		{"_orders._udp.svc.local.", dns.TypeSRV, dns.RcodeSuccess},
+		{"svc.local.", dns.TypeA, dns.RcodeSuccess},
+		// names above services exist, RFC 8020
+		{"_tcp.svc.local.", dns.TypeA, dns.RcodeSuccess},
+		{"_TCP.svc.local.", dns.TypeSRV, dns.RcodeSuccess},
+		{"go.svc.local.", dns.TypeA, dns.RcodeSuccess},
+		{"_tcp.go.svc.local.", dns.TypeSRV, dns.RcodeSuccess},
+		{"payment_group.svc.local.", dns.TypeA, dns.RcodeNameError},
+		{"x.go.svc.local.", dns.TypeA, dns.RcodeNameError},
+		{"_tcp.unknown.svc.local.", dns.TypeSRV, dns.RcodeNameError},
+	}
+
+	for _, tc := range tests {
+		code, resp := serve(t, vs, tc.qname, tc.qtype)
+		assert.Equal(t, dns.RcodeSuccess, code, tc.qname)
+		assert.Equal(t, tc.rcode, resp.Rcode, tc.qname)
+		assert.True(t, resp.Authoritative, tc.qname)
+		assert.Empty(t, resp.Answer, tc.qname)
+		if assert.Len(t, resp.Ns, 1, tc.qname) {
+			soa := resp.Ns[0].(*dns.SOA)
+			assert.Equal(t, "svc.local.", soa.Hdr.Name)
+			assert.Equal(t, "ns.dns.svc.local.", soa.Ns)
+			assert.Equal(t, "hostmaster.svc.local.", soa.Mbox)
+			assert.Equal(t, uint32(1700000000), soa.Serial)
+			assert.Equal(t, uint32(30), soa.Minttl)
+		}
+	}
+
+	vs.SOA.Ns, vs.SOA.Mbox = "ns1.example.com.", "dns.example.com."
+	_, resp := serve(t, vs, "svc.local.", dns.TypeSOA)
+	if assert.Len(t, resp.Answer, 1) {
+		soa := resp.Answer[0].(*dns.SOA)
+		assert.Equal(t, "ns1.example.com.", soa.Ns)
+		assert.Equal(t, "dns.example.com.", soa.Mbox)
+	}
+	assert.Empty(t, resp.Ns)
+}
+
+func TestNacos_ServeDNSFallthrough(t *testing.T) {
+	vs := newTestNacos([]string{"svc.local.", "other.local."}, testService("orders", "10.0.0.1"), testService("billing"))
+	vs.DNSCache = vs.NacosClientImpl.GetDNSCache()
+	vs.Fall.SetZonesFromArgs([]string{"svc.local."})
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		code  int // RcodeRefused comes from the next plugin
+		rcode int
+	}{
+		{"unknown.svc.local.", dns.TypeA, dns.RcodeRefused, 0},
+		{"billing.svc.local.", dns.TypeA, dns.RcodeRefused, 0},
+		{"billing.svc.local.", dns.TypeA, dns.RcodeRefused, 0},
+		{"_billing._tcp.svc.local.", dns.TypeSRV, dns.RcodeRefused, 0},
+		{"10-0-0-9.orders.svc.local.", dns.TypeA, dns.RcodeRefused, 0},
+		// orders has instances, just not of this family or type
+		{"orders.svc.local.", dns.TypeAAAA, dns.RcodeSuccess, dns.RcodeSuccess},
+		{"orders.svc.local.", dns.TypeTXT, dns.RcodeSuccess, dns.RcodeSuccess},
+		{"svc.local.", dns.TypeSOA, dns.RcodeSuccess, dns.RcodeSuccess},
+		{"unknown.other.local.", dns.TypeA, dns.RcodeSuccess, dns.RcodeNameError},
+		{"billing.other.local.", dns.TypeA, dns.RcodeSuccess, dns.RcodeSuccess},
+	}
+
+	for _, tc := range tests {
+		code, resp := serve(t, vs, tc.qname, tc.qtype)
+		assert.Equal(t, tc.code, code, tc.qname)
+		if tc.code == dns.RcodeSuccess {
+			assert.Equal(t, tc.rcode, resp.Rcode, tc.qname)
+		}
+	}
+
+	_, resp := serve(t, vs, "orders.svc.local.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+}
+
+func TestNacos_ServeDNSAddressFamily(t *testing.T) {
+	vs := newTestNacos([]string{"svc.local."}, testService("orders", "10.0.0.1", "fd00::1", "10.0.0.2", "fd00::2"))
+
+	writers := []dns.ResponseWriter{
+		&test.ResponseWriter{},
+		&test.ResponseWriter{TCP: true},
+		&test.ResponseWriter6{},
+		&test.ResponseWriter6{ResponseWriter: test.ResponseWriter{TCP: true}},
+	}
+
+	for _, w := range writers {
+		_, resp := serveWith(t, vs, w, "orders.svc.local.", dns.TypeA)
+		if assert.Len(t, resp.Answer, 2) {
+			assert.Equal(t, "10.0.0.1", resp.Answer[0].(*dns.A).A.String())
+			assert.Equal(t, "10.0.0.2", resp.Answer[1].(*dns.A).A.String())
+		}
+
+		_, resp = serveWith(t, vs, w, "orders.svc.local.", dns.TypeAAAA)
+		if assert.Len(t, resp.Answer, 2) {
+			assert.Equal(t, "fd00::1", resp.Answer[0].(*dns.AAAA).AAAA.String())
+			assert.Equal(t, "fd00::2", resp.Answer[1].(*dns.AAAA).AAAA.String())
+		}
+	}
+
+	// an IPv4 only service has no AAAA records
+	vs = newTestNacos([]string{"svc.local."}, testService("billing", "10.0.0.1"))
+	_, resp := serveWith(t, vs, &test.ResponseWriter6{}, "billing.svc.local.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+	assert.Len(t, resp.Ns, 1)
+}
+
+func TestNacos_ServeDNSTTL(t *testing.T) {
+	orders := testService("orders", "10.0.0.1", "10.0.0.2")
+	orders.CacheMillis = 10000
+	billing := testService("billing", "10.0.1.1", "10.0.1.2")
+	billing.CacheMillis = 10000
+	billing.Hosts[0].Metadata = map[string]string{TTLMetadataKey: "60"}
+	billing.Hosts[1].Metadata = map[string]string{TTLMetadataKey: "30"}
+	volatile := testService("volatile", "10.0.2.1")
+	volatile.CacheMillis = 500
+	vs := newTestNacos([]string{"svc.local."}, orders, billing, volatile)
+
+	ttl := func(qname string, qtype uint16) uint32 {
+		_, resp := serve(t, vs, qname, qtype)
+		if !assert.NotEmpty(t, resp.Answer, qname) {
+			return 0
+		}
+		for _, rr := range append(resp.Answer, resp.Extra...) {
+			assert.Equal(t, resp.Answer[0].Header().Ttl, rr.Header().Ttl, qname)
+		}
+		return resp.Answer[0].Header().Ttl
+	}
+
+	assert.Equal(t, uint32(10), ttl("orders.svc.local.", dns.TypeA))
+	assert.Equal(t, uint32(10), ttl("_orders._tcp.svc.local.", dns.TypeSRV))
+	assert.Equal(t, uint32(30), ttl("billing.svc.local.", dns.TypeA))
+	assert.Equal(t, uint32(60), ttl("10-0-1-1.billing.svc.local.", dns.TypeA))
+	assert.Equal(t, uint32(1), ttl("volatile.svc.local.", dns.TypeA))
+
+	// the service metadata overrides cacheMillis, the instance metadata both
+	backend := vs.NacosClientImpl.naming().(*fakeBackend)
+	backend.SetMetadata("DEFAULT_GROUP@@orders", map[string]string{TTLMetadataKey: "45"})
+	backend.SetMetadata("DEFAULT_GROUP@@billing", map[string]string{TTLMetadataKey: "120"})
+	assert.Equal(t, uint32(10), ttl("orders.svc.local.", dns.TypeA))
+	for _, key := range []string{"DEFAULT_GROUP@@orders", "DEFAULT_GROUP@@billing"} {
+		assert.NoError(t, vs.NacosClientImpl.refreshMetadata(key))
+	}
+	assert.Equal(t, uint32(45), ttl("orders.svc.local.", dns.TypeA))
+	assert.Equal(t, uint32(45), ttl("_orders._tcp.svc.local.", dns.TypeSRV))
+	assert.Equal(t, uint32(30), ttl("billing.svc.local.", dns.TypeA))
+
+	vs.MinTTL, vs.MaxTTL = 5, 20
+	assert.Equal(t, uint32(20), ttl("orders.svc.local.", dns.TypeA))
+	assert.Equal(t, uint32(20), ttl("10-0-1-1.billing.svc.local.", dns.TypeA))
+	assert.Equal(t, uint32(5), ttl("volatile.svc.local.", dns.TypeA))
+}
+
+func TestNacos_ServeDNSCache(t *testing.T) {
+	vs := newTestNacos([]string{"svc.local."}, testService("orders", "10.0.0.1"), testService("billing", "10.0.1.1"))
+	vs.DNSCache = vs.NacosClientImpl.GetDNSCache()
+
+	_, resp := serve(t, vs, "orders.svc.local.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+	_, resp = serve(t, vs, "billing.svc.local.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+	_, resp = serve(t, vs, "unknown.svc.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Equal(t, 2, vs.DNSCache.Count())
+
+	// the cached response is served even though the service changed behind
+	// the client's back
+	vs.NacosClientImpl.GetDomainCache().Set("DEFAULT_GROUP@@orders", testService("orders", "10.0.0.1", "10.0.0.2"))
+	_, resp = serve(t, vs, "ORDERS.svc.local.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, "ORDERS.svc.local.", resp.Question[0].Name)
+
+	// a push invalidates the responses of the pushed service only
+	vs.NacosClientImpl.backend.(*fakeBackend).SetService(testService("orders", "10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	assert.Equal(t, 1, vs.DNSCache.Count())
+
+	_, resp = serve(t, vs, "orders.svc.local.", dns.TypeA)
+	assert.Len(t, resp.Answer, 3)
+}
+
+func TestNacos_ServeDNSBalancer(t *testing.T) {
+	orders := testService("orders", "10.0.0.1", "fd00::1", "10.0.0.2", "10.0.0.3")
+	orders.Hosts[2].Weight = 2
+	vs := newTestNacos([]string{"svc.local."}, orders)
+	vs.DNSCache = vs.NacosClientImpl.GetDNSCache()
+	vs.Balancer = NewBalancer(PolicyRoundRobin, 2)
+
+	var leads []string
+	for i := 0; i < 3; i++ {
+		_, resp := serve(t, vs, "orders.svc.local.", dns.TypeA)
+		if assert.Len(t, resp.Answer, 2) {
+			leads = append(leads, resp.Answer[0].(*dns.A).A.String())
+		}
+	}
+	// balanced answers are not cached
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, leads)
+	assert.Equal(t, 0, vs.DNSCache.Count())
+
+	_, resp := serve(t, vs, "orders.svc.local.", dns.TypeAAAA)
+	assert.Len(t, resp.Answer, 1)
+
+	// SRV records carry the weights and answer every instance
+	_, resp = serve(t, vs, "_orders._tcp.svc.local.", dns.TypeSRV)
+	if assert.Len(t, resp.Answer, 4) {
+		assert.Equal(t, uint16(200), resp.Answer[2].(*dns.SRV).Weight)
+	}
+	assert.Equal(t, 1, vs.DNSCache.Count())
+}
+
+func TestNacos_ServeDNSSites(t *testing.T) {
+	orders := testService("orders", "10.0.0.1", "10.1.0.1", "fd00::1")
+	orders.Hosts[0].Metadata = map[string]string{"site": "hz"}
+	orders.Hosts[1].Metadata = map[string]string{"site": "sh"}
+	orders.Hosts[2].Metadata = map[string]string{"site": "sh"}
+	vs := newTestNacos([]string{"svc.local."}, orders)
+	vs.DNSCache = vs.NacosClientImpl.GetDNSCache()
+	vs.Sites = testSites(t, map[string][]string{"hz": {"10.240.0.0/16"}, "sh": {"10.241.0.0/16"}})
+
+	answer := func(remoteIP string, qtype uint16) []string {
+		_, resp := serveWith(t, vs, &test.ResponseWriter{RemoteIP: remoteIP}, "orders.svc.local.", qtype)
+		var result []string
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				result = append(result, rr.A.String())
+			case *dns.AAAA:
+				result = append(result, rr.AAAA.String())
+			}
+		}
+		return result
+	}
+
+	for i := 0; i < 2; i++ { // the second round is served from the cache
+		assert.Equal(t, []string{"10.0.0.1"}, answer("10.240.0.1", dns.TypeA))
+		assert.Equal(t, []string{"10.1.0.1"}, answer("10.241.0.1", dns.TypeA))
+		assert.Equal(t, []string{"10.0.0.1", "10.1.0.1"}, answer("172.16.0.1", dns.TypeA))
+		// hz has no IPv6 instance
+		assert.Equal(t, []string{"fd00::1"}, answer("10.240.0.1", dns.TypeAAAA))
+	}
+	assert.Equal(t, 4, vs.DNSCache.Count())
+
+	// the other sites answer once the local instance is gone
+	vs.NacosClientImpl.backend.(*fakeBackend).SetService(testService("orders", "10.1.0.1"))
+	assert.Equal(t, []string{"10.1.0.1"}, answer("10.240.0.1", dns.TypeA))
+
+	_, resp := serveWith(t, vs, &test.ResponseWriter{RemoteIP: "10.241.0.1"}, "_orders._tcp.svc.local.", dns.TypeSRV)
+	assert.Len(t, resp.Answer, 1)
+}
+
+func TestNacos_ServeDNSClientSubnet(t *testing.T) {
+	orders := testService("orders", "10.0.0.1", "10.1.0.1")
+	orders.Hosts[0].Metadata = map[string]string{"site": "hz"}
+	orders.Hosts[1].Metadata = map[string]string{"site": "sh"}
+	vs := newTestNacos([]string{"svc.local."}, orders)
+	vs.DNSCache = vs.NacosClientImpl.GetDNSCache()
+
+	// the resolver sits in sh, its clients anywhere
+	resolver := &test.ResponseWriter{RemoteIP: "10.241.0.1"}
+	query := func(subnet string, netmask uint8) (answer []string, ecs *dns.EDNS0_SUBNET) {
+		m := new(dns.Msg)
+		m.SetQuestion("orders.svc.local.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		m.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: netmask, Address: net.ParseIP(subnet)}}
+		rec := dnstest.NewRecorder(resolver)
+		_, err := vs.ServeDNS(context.TODO(), rec, m)
+		assert.NoError(t, err)
+		for _, rr := range rec.Msg.Answer {
+			answer = append(answer, rr.(*dns.A).A.String())
+		}
+		if assert.NotNil(t, rec.Msg.IsEdns0()) {
+			ecs = clientSubnet(rec.Msg)
+		}
+		return answer, ecs
+	}
+
+	// without sites the answers do not depend on the client
+	answer, ecs := query("10.240.5.0", 24)
+	assert.Equal(t, []string{"10.0.0.1", "10.1.0.1"}, answer)
+	if assert.NotNil(t, ecs) {
+		assert.Equal(t, uint8(24), ecs.SourceNetmask)
+		assert.Equal(t, uint8(0), ecs.SourceScope)
+		assert.Equal(t, "10.240.5.0", ecs.Address.String())
+	}
+	vs.NacosClientImpl.purgeDNSCache()
+
+	vs.Sites = testSites(t, map[string][]string{"hz": {"10.240.0.0/16"}, "sh": {"10.241.0.0/16"}})
+	for i := 0; i < 2; i++ { // the second round is served from the cache
+		answer, ecs = query("10.240.5.0", 24)
+		assert.Equal(t, []string{"10.0.0.1"}, answer)
+		if assert.NotNil(t, ecs) {
+			assert.Equal(t, uint8(24), ecs.SourceScope)
+			assert.Equal(t, "10.240.5.0", ecs.Address.String())
+		}
+
+		answer, ecs = query("10.240.6.0", 24)
+		assert.Equal(t, []string{"10.0.0.1"}, answer)
+		if assert.NotNil(t, ecs) {
+			assert.Equal(t, "10.240.6.0", ecs.Address.String())
+		}
+
+		// a /0 keeps the client to itself, the resolver's site does not count
+		answer, ecs = query("0.0.0.0", 0)
+		assert.Equal(t, []string{"10.0.0.1", "10.1.0.1"}, answer)
+		if assert.NotNil(t, ecs) {
+			assert.Equal(t, uint8(0), ecs.SourceScope)
+		}
+	}
+	_, ok := vs.DNSCache.Get(DnsCacheKey("orders.svc.local.", dns.TypeA, "10.240.5.0/24"))
+	assert.True(t, ok)
+	assert.Equal(t, 3, vs.DNSCache.Count())
+
+	// queries without the option are still answered by the site of the sender
+	_, resp := serveWith(t, vs, resolver, "orders.svc.local.", dns.TypeA)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "10.1.0.1", resp.Answer[0].(*dns.A).A.String())
+	}
+	assert.Nil(t, resp.IsEdns0())
+
+	// balanced answers rotate per site, not per subnet the clients make up
+	vs.Balancer = NewBalancer(PolicyRoundRobin, 1)
+	for i := 0; i < 256; i++ {
+		answer, _ = query("10.240."+strconv.Itoa(i)+".0", 24)
+		assert.Equal(t, []string{"10.0.0.1"}, answer)
+	}
+	assert.Len(t, vs.Balancer.offsets, 1)
+
+	// a site network narrower than the source prefix narrows the scope
+	vs.Balancer = nil
+	vs.Sites = testSites(t, map[string][]string{"hz": {"10.242.0.0/26"}, "sh": {"10.241.0.0/16"}})
+	for i := 0; i < 2; i++ { // the second round is served from the cache
+		answer, ecs = query("10.242.0.0", 24)
+		assert.Equal(t, []string{"10.0.0.1"}, answer)
+		if assert.NotNil(t, ecs) {
+			assert.Equal(t, uint8(24), ecs.SourceNetmask)
+			assert.Equal(t, uint8(26), ecs.SourceScope)
+			assert.Equal(t, "10.242.0.0", ecs.Address.String())
+		}
+	}
+	_, ok = vs.DNSCache.Get(DnsCacheKey("orders.svc.local.", dns.TypeA, "10.242.0.0/26"))
+	assert.True(t, ok)
+}
+
+func BenchmarkNacos_ServeDNS(b *testing.B) {
+	vs := newTestNacos([]string{"svc.local."}, testService("orders", "10.0.0.1", "10.0.0.2", "fd00::1"))
+	r := new(dns.Msg)
+	r.SetQuestion("orders.svc.local.", dns.TypeA)
+	w := &test.ResponseWriter{}
+	ctx := context.TODO()
+
+	b.Run("uncached", func(b *testing.B) {
+		vs.DNSCache = nil
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			vs.ServeDNS(ctx, w, r)
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		vs.DNSCache = vs.NacosClientImpl.GetDNSCache()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			vs.ServeDNS(ctx, w, r)
+		}
+	})
+}
+
+func TestNacos_ServeDNSIndependentBlocks(t *testing.T) {
+	public := newTestNacos([]string{"public.local."}, testService("orders", "10.0.0.1"))
+	dev := newTestNacos([]string{"dev.local."}, testService("orders", "10.1.0.1"), testService("billing", "10.1.1.1"))
+	dev.TTL = 5
+
+	_, resp := serve(t, public, "orders.public.local.", dns.TypeA)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "10.0.0.1", resp.Answer[0].(*dns.A).A.String())
+	}
+	_, resp = serve(t, dev, "orders.dev.local.", dns.TypeA)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "10.1.0.1", resp.Answer[0].(*dns.A).A.String())
+	}
+
+	_, resp = serve(t, public, "billing.public.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	assert.False(t, public.NacosClientImpl.Registered("DEFAULT_GROUP@@billing"))
+	assert.True(t, dev.NacosClientImpl.Registered("DEFAULT_GROUP@@billing"))
+	assert.Equal(t, DefaultTTL, public.TTL)
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import "github.com/nacos-group/nacos-sdk-go/v2/model"
+
+// NamingBackend is what a NacosClient needs from a Nacos server. Services are
+// addressed by their group qualified name, see ServiceKey.
+type NamingBackend interface {
+	// ListServices returns the keys of the services in the configured groups.
+	ListServices() ([]string, error)
+	GetService(serviceKey string) (model.Service, error)
+	// GetServiceMetadata returns the metadata of the service itself, which the
+	// instance lists of GetService do not carry.
+	GetServiceMetadata(serviceKey string) (map[string]string, error)
+	// Subscribe calls push with the current instances of the service whenever
+	// they change, until Unsubscribe.
+	Subscribe(serviceKey string, push PushFunc) error
+	Unsubscribe(serviceKey string) error
+	// Close releases the connection to the server.
+	Close()
+}
+
+// PushFunc receives the instances of a subscribed service. An empty list means
+// the service has no instances left.
+type PushFunc func(serviceKey string, instances []model.Instance)
@@ -0,0 +1,213 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBackend is an in-memory Nacos server. Tests script it with SetService,
+// SetMetadata, RemoveService and SetDown.
+type fakeBackend struct {
+	lock     sync.Mutex
+	services map[string]model.Service
+	metadata map[string]map[string]string
+	pushes   map[string]PushFunc
+	attempts int // Subscribe calls, failed ones included
+	down     bool
+	closed   bool
+}
+
+func newFakeBackend(services ...model.Service) *fakeBackend {
+	f := &fakeBackend{
+		services: make(map[string]model.Service),
+		metadata: make(map[string]map[string]string),
+		pushes:   make(map[string]PushFunc),
+	}
+	for _, service := range services {
+		f.services[ServiceKey(service.Name, service.GroupName)] = service
+	}
+	return f
+}
+
+func (f *fakeBackend) ListServices() ([]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.down {
+		return nil, NacosClientError{"nacos is down"}
+	}
+	var keys []string
+	for key := range f.services {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (f *fakeBackend) GetService(serviceKey string) (model.Service, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.down {
+		return model.Service{}, NacosClientError{"nacos is down"}
+	}
+	return f.services[serviceKey], nil
+}
+
+func (f *fakeBackend) GetServiceMetadata(serviceKey string) (map[string]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.down {
+		return nil, NacosClientError{"nacos is down"}
+	}
+	return f.metadata[serviceKey], nil
+}
+
+func (f *fakeBackend) Subscribe(serviceKey string, push PushFunc) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.attempts++
+	if f.down {
+		return NacosClientError{"nacos is down"}
+	}
+	f.pushes[serviceKey] = push
+	return nil
+}
+
+func (f *fakeBackend) Unsubscribe(serviceKey string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.pushes, serviceKey)
+	return nil
+}
+
+func (f *fakeBackend) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+}
+
+// SetService registers or replaces a service and pushes its instances to a
+// subscriber.
+func (f *fakeBackend) SetService(service model.Service) {
+	key := ServiceKey(service.Name, service.GroupName)
+	f.lock.Lock()
+	f.services[key] = service
+	push := f.pushes[key]
+	f.lock.Unlock()
+
+	if push != nil {
+		push(key, service.Hosts)
+	}
+}
+
+// SetMetadata replaces the metadata of a service, which is not pushed.
+func (f *fakeBackend) SetMetadata(serviceKey string, metadata map[string]string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.metadata[serviceKey] = metadata
+}
+
+// RemoveService deregisters every instance of a service and pushes the empty
+// list to a subscriber.
+func (f *fakeBackend) RemoveService(serviceKey string) {
+	f.lock.Lock()
+	service := f.services[serviceKey]
+	service.Hosts = nil
+	f.services[serviceKey] = service
+	push := f.pushes[serviceKey]
+	f.lock.Unlock()
+
+	if push != nil {
+		push(serviceKey, nil)
+	}
+}
+
+// SetDown makes every request fail, as if the server were unreachable.
+func (f *fakeBackend) SetDown(down bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.down = down
+}
+
+func (f *fakeBackend) subscribeAttempts() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.attempts
+}
+
+func (f *fakeBackend) subscribed(serviceKey string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.pushes[serviceKey] != nil
+}
+
+func TestNamingBackend_Resolve(t *testing.T) {
+	backend := newFakeBackend(testService("orders", "10.0.0.1"))
+	vc := newNacosClient(NacosClientConfig{}, backend)
+	vc.getAllServiceNames()
+	vs := &Nacos{Zones: []string{"svc.local."}, NacosClientImpl: vc, SOA: DefaultSOAConfig(), TTL: DefaultTTL}
+	vs.DNSCache = vc.GetDNSCache()
+
+	// the first query fetches the service and subscribes to it
+	_, resp := serve(t, vs, "orders.svc.local.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+	assert.Eventually(t, func() bool { return backend.subscribed("DEFAULT_GROUP@@orders") }, 3*time.Second, 10*time.Millisecond)
+
+	backend.SetService(testService("orders", "10.0.0.1", "10.0.0.2"))
+	_, resp = serve(t, vs, "orders.svc.local.", dns.TypeA)
+	assert.Len(t, resp.Answer, 2)
+
+	// unknown until the service list is refreshed
+	backend.SetService(testService("billing", "10.0.1.1"))
+	_, resp = serve(t, vs, "billing.svc.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	vc.getAllServiceNames()
+	_, resp = serve(t, vs, "billing.svc.local.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+
+	// the last known instances are served while the server is unreachable
+	backend.SetDown(true)
+	vc.getAllServiceNames()
+	vc.getServiceNow("DEFAULT_GROUP@@orders", &vc.serviceMap, "")
+	_, resp = serve(t, vs, "orders.svc.local.", dns.TypeA)
+	assert.Len(t, resp.Answer, 2)
+	backend.SetDown(false)
+
+	// a service without instances is unsubscribed and answers NODATA
+	backend.RemoveService("DEFAULT_GROUP@@orders")
+	assert.False(t, vc.Subscribed("DEFAULT_GROUP@@orders"))
+	_, resp = serve(t, vs, "orders.svc.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+
+	vc.Stop()
+	assert.False(t, backend.subscribed("DEFAULT_GROUP@@billing"))
+	assert.True(t, backend.closed)
+}
+
+func TestNamingBackend_EmptyList(t *testing.T) {
+	vc := newNacosClient(NacosClientConfig{}, newFakeBackend())
+	vc.getAllServiceNames()
+	vs := &Nacos{Zones: []string{"svc.local."}, NacosClientImpl: vc, SOA: DefaultSOAConfig(), TTL: DefaultTTL}
+
+	_, resp := serve(t, vs, "orders.svc.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// nonTerminals indexes the names which exist only because services are named
+// below them, like _tcp above _orders._tcp or payment_group above
+// orders.payment_group. RFC 8020 resolvers deny everything below an NXDOMAIN,
+// so these answer NODATA. The index is rebuilt when the known services change,
+// looking a name up does not walk the services.
+type nonTerminals struct {
+	lock     sync.RWMutex
+	listed   int64 // NacosClient.listVersion the index was built for
+	cached   int   // services cached when the index was built
+	built    bool
+	scheme   string // the naming scheme and groups the index was built for
+	groups   []string
+	names    map[string]bool // proper suffixes of the service names
+	srvRests map[string]bool // the labels following _<proto> in SRV names
+}
+
+// emptyNonTerminal reports whether name, the labels in front of the zone, is
+// not a service but a service is named below it.
+func (vs *Nacos) emptyNonTerminal(name string) bool {
+	name = strings.ToLower(name)
+	index := &vs.nonTerminals
+	listed, cached := vs.NacosClientImpl.servicesVersion()
+
+	index.lock.RLock()
+	if !index.built || index.listed != listed || index.cached != cached ||
+		index.scheme != vs.NamingScheme || !slices.Equal(index.groups, vs.Groups) {
+		index.lock.RUnlock()
+		index.lock.Lock()
+		vs.buildNonTerminals(listed, cached)
+		index.lock.Unlock()
+		index.lock.RLock()
+	}
+	defer index.lock.RUnlock()
+
+	if index.names[name] {
+		return true
+	}
+	// _<service>._<proto>.<rest> names the service <service>.<rest>, so
+	// _<proto>.<rest> is above it
+	if len(name) > 1 && name[0] == '_' {
+		var rest string
+		if i := strings.Index(name, "."); i > 0 {
+			rest = name[i+1:]
+		}
+		return index.srvRests[rest]
+	}
+	return false
+}
+
+// buildNonTerminals indexes the names of the known services. The caller holds
+// the write lock.
+func (vs *Nacos) buildNonTerminals(listed int64, cached int) {
+	index := &vs.nonTerminals
+	names, srvRests := map[string]bool{}, map[string]bool{}
+	for _, key := range vs.NacosClientImpl.serviceKeys() {
+		for _, dnsName := range vs.dnsNames(key) {
+			dnsName = strings.ToLower(dnsName)
+			labels := strings.Split(dnsName, ".")
+			for i := 1; i < len(labels); i++ {
+				names[strings.Join(labels[i:], ".")] = true
+			}
+			srvRests[strings.Join(labels[1:], ".")] = true
+		}
+	}
+	index.names, index.srvRests = names, srvRests
+	index.listed, index.cached, index.built = listed, cached, true
+	index.scheme, index.groups = vs.NamingScheme, append([]string(nil), vs.Groups...)
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNacos_emptyNonTerminal(t *testing.T) {
+	vs := newTestNacos([]string{"svc.local."}, testService("orders", "10.0.0.1"), testService("demo.go", "10.0.0.2"))
+	assert.True(t, vs.emptyNonTerminal("go"))
+	assert.True(t, vs.emptyNonTerminal("_tcp"))
+	assert.True(t, vs.emptyNonTerminal("_tcp.go"))
+	assert.False(t, vs.emptyNonTerminal("orders"))
+	assert.False(t, vs.emptyNonTerminal("io"))
+
+	// the index follows the services listed
+	vs.NacosClientImpl.backend.(*fakeBackend).SetService(testService("demo.io", "10.0.0.3"))
+	vs.NacosClientImpl.getAllServiceNames()
+	assert.True(t, vs.emptyNonTerminal("io"))
+
+	// and the naming scheme
+	vs.Groups = []string{"DEFAULT_GROUP"}
+	assert.False(t, vs.emptyNonTerminal("default_group"))
+	vs.NamingScheme = SchemeServiceGroup
+	assert.True(t, vs.emptyNonTerminal("default_group"))
+}
+
+func TestNacos_emptyNonTerminalAllocs(t *testing.T) {
+	vs := newTestNacos([]string{"svc.local."})
+	for i := 0; i < 5000; i++ {
+		key := ServiceKey("service"+strconv.Itoa(i), "DEFAULT_GROUP")
+		vs.NacosClientImpl.allDoms.Data[key] = true
+	}
+	vs.emptyNonTerminal("warm")
+
+	// NXDOMAINs are not cached, their lookup must not walk the services
+	allocs := testing.AllocsPerRun(100, func() { vs.emptyNonTerminal("random-label") })
+	assert.Zero(t, allocs)
+}
+
+func BenchmarkNacos_ServeDNSNameError(b *testing.B) {
+	vs := newTestNacos([]string{"svc.local."})
+	for i := 0; i < 5000; i++ {
+		vs.NacosClientImpl.allDoms.Data[ServiceKey("service"+strconv.Itoa(i), "DEFAULT_GROUP")] = true
+	}
+	r := new(dns.Msg)
+	r.SetQuestion("random-label.svc.local.", dns.TypeA)
+	w := &test.ResponseWriter{}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		vs.ServeDNS(context.TODO(), w, r)
+	}
+}
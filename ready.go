@@ -0,0 +1,40 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"sync/atomic"
+)
+
+// contacted records a successful exchange with Nacos.
+func (vc *NacosClient) contacted() {
+	atomic.StoreInt64(&vc.contactMillis, CurrentMillis())
+}
+
+// Ready reports whether the client can answer: it listed the services of Nacos
+// once, or loaded services cached on disk, and, with a HealthTimeout, heard
+// from Nacos within it.
+func (vc *NacosClient) Ready() bool {
+	if atomic.LoadInt32(&vc.listed) == 0 && !vc.cacheLoaded {
+		return false
+	}
+	timeout := vc.config.HealthTimeout.Milliseconds()
+	return timeout <= 0 || CurrentMillis()-atomic.LoadInt64(&vc.contactMillis) <= timeout
+}
+
+// Ready implements ready.Readiness, the ready plugin reports CoreDNS ready
+// once every nacos block is.
+func (vs *Nacos) Ready() bool {
+	return vs.NacosClientImpl.Ready()
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/ready"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ ready.Readiness = &Nacos{}
+
+func TestNacosClient_Ready(t *testing.T) {
+	vc := NewNacosClientTEST()
+	backend := vc.naming().(*fakeBackend)
+	vs := &Nacos{NacosClientImpl: vc}
+
+	// not ready before the first listing
+	backend.SetDown(true)
+	vc.getAllServiceNames()
+	assert.False(t, vs.Ready())
+
+	backend.SetDown(false)
+	vc.getAllServiceNames()
+	assert.True(t, vs.Ready())
+
+	// losing contact to Nacos only matters with a health_timeout
+	backend.SetDown(true)
+	vc.contactMillis = CurrentMillis() - 60000
+	vc.getAllServiceNames()
+	assert.True(t, vs.Ready())
+	vc.config.HealthTimeout = 30 * time.Second
+	assert.False(t, vs.Ready())
+
+	backend.SetDown(false)
+	vc.getAllServiceNames()
+	assert.True(t, vs.Ready())
+
+	// a push is contact as well
+	vc.contactMillis = CurrentMillis() - 60000
+	vc.Subscribe("DEFAULT_GROUP@@demo.go")
+	backend.SetService(testService("demo.go", "10.0.0.9"))
+	assert.True(t, vs.Ready())
+}
+
+func TestNacosClient_ReadyFromSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	vc := newNacosClient(NacosClientConfig{CachePath: dir}, newFakeBackend())
+	vc.naming().(*fakeBackend).SetDown(true)
+	vc.loadSnapshot()
+	assert.False(t, vc.Ready())
+
+	assert.NoError(t, os.WriteFile(vc.snapshotPath(), []byte("{"), 0644))
+	vc.loadSnapshot()
+	assert.False(t, vc.Ready())
+
+	assert.NoError(t, os.WriteFile(vc.snapshotPath(), []byte(`{"version":2,"names":["DEFAULT_GROUP@@orders"],`+
+		`"services":{"DEFAULT_GROUP@@orders":{"name":"orders","hosts":[{"ip":"10.0.0.1","port":80,"weight":1,"healthy":true,"enabled":true}]}}}`), 0644))
+	vc.loadSnapshot()
+	assert.True(t, vc.Ready())
+}
@@ -46,7 +46,7 @@ func (manager *ServerManager) RefreshServerListIfNeed() []string {
 
 	if len(servers) > 0 {
 		if !reflect.DeepEqual(manager.serverList, servers) {
-			NacosClientLogger.Info("server list is updated, old: ", manager.serverList, ", new: ", servers)
+			log.Infof("Server list updated, old: %v, new: %v", manager.serverList, servers)
 		}
 		manager.serverList = servers
 
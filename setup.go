@@ -14,13 +14,16 @@
 package nacos
 
 import (
-	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"github.com/nacos-group/nacos-sdk-go/v2/common/constant"
 )
 
 func init() {
@@ -28,7 +31,6 @@ func init() {
 		ServerType: "dns",
 		Action:     setup,
 	})
-	fmt.Println("register nacos plugin")
 }
 
 func setup(c *caddy.Controller) error {
@@ -36,6 +38,22 @@ func setup(c *caddy.Controller) error {
 	if err != nil {
 		return plugin.Error("nacos", err)
 	}
+	c.OnStartup(func() error {
+		vs.NacosClientImpl.Start()
+		return nil
+	})
+	c.OnShutdown(func() error {
+		vs.NacosClientImpl.Stop()
+		return nil
+	})
+	if vs.Admin != nil {
+		// the listener of the old instance is in the way of a reload
+		c.OnStartup(vs.Admin.Start)
+		c.OnRestart(vs.Admin.Stop)
+		c.OnRestartFailed(vs.Admin.Start)
+		c.OnShutdown(vs.Admin.Stop)
+	}
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		vs.Next = next
 		return vs
@@ -43,62 +61,262 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
+// singleArg returns the only argument of the current property.
+func singleArg(c *caddy.Controller) (string, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return "", c.ArgErr()
+	}
+	return args[0], nil
+}
+
+func uint32Arg(c *caddy.Controller) (uint32, error) {
+	directive := c.Val()
+	arg, err := singleArg(c)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		return 0, c.Errf("invalid %s '%s'", directive, arg)
+	}
+	return uint32(v), nil
+}
+
 func NacosParse(c *caddy.Controller) (*Nacos, error) {
-	fmt.Println("init nacos plugin...")
 	nacosImpl := Nacos{}
-	var serverHosts = make([]string, 0)
-	namespaceId := ""
-	userName := ""
-	password := ""
+	config := NacosClientConfig{}
+	nacosImpl.TTL = DefaultTTL
+	nacosImpl.Groups = []string{constant.DEFAULT_GROUP}
+	nacosImpl.NamingScheme = SchemeService
+	nacosImpl.SOA = DefaultSOAConfig()
+	nacosImpl.MaxTTL = 3600
+	policy, maxAnswers := PolicyAll, uint32(0)
+	var adminListen, adminToken string
 
 	for c.Next() {
-		nacosImpl.Zones = c.RemainingArgs()
-		if c.NextBlock() {
-			for {
-				switch v := c.Val(); v {
-				case "nacos_namespaceId":
-					namespaceId = c.RemainingArgs()[0]
-				case "nacos_server_host":
-					serverHosts = strings.Split(c.RemainingArgs()[0], ",")
-				case "nacos_username":
-					userName = c.RemainingArgs()[0]
-				case "nacos_password":
-					password = c.RemainingArgs()[0]
-				//case "nacos_server":
-				//	servers = strings.Split(c.RemainingArgs()[0], ",")
-				/* it is nacos_servera noop now */
-				//case "nacos_server_port":
-				//	port, err := strconv.Atoi(c.RemainingArgs()[0])
-				//	if err != nil {
-				//		serverPort = port
-				//	}
-
-				case "cache_ttl":
-					ttl, err := strconv.Atoi(c.RemainingArgs()[0])
-					if err != nil {
-						DNSTTL = uint32(ttl)
+		nacosImpl.Zones = plugin.OriginsFromArgsOrServerBlock(c.RemainingArgs(), c.ServerBlockKeys)
+		if len(nacosImpl.Zones) == 0 {
+			nacosImpl.Zones = []string{"."}
+		}
+		for c.NextBlock() {
+			var err error
+			switch v := c.Val(); v {
+			case "nacos_namespaceId":
+				config.NamespaceId, err = singleArg(c)
+			case "nacos_server_host":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return &Nacos{}, c.ArgErr()
+				}
+				// comma or space separated
+				for _, arg := range args {
+					for _, serverHost := range strings.Split(arg, ",") {
+						host, port, err := parseServerHost(serverHost)
+						if err != nil {
+							return &Nacos{}, c.Errf("invalid nacos_server_host '%s': %s", serverHost, err)
+						}
+						config.ServerHosts = append(config.ServerHosts, net.JoinHostPort(host, strconv.FormatUint(port, 10)))
 					}
-				case "cache_dir":
-					CachePath = c.RemainingArgs()[0]
-				case "log_path":
-					LogPath = c.RemainingArgs()[0]
+				}
+			case "nacos_username":
+				config.Username, err = singleArg(c)
+			case "nacos_password":
+				config.Password, err = singleArg(c)
+			case "nacos_password_file":
+				config.PasswordFile, err = singleArg(c)
+			case "nacos_access_key":
+				config.AccessKey, err = singleArg(c)
+			case "nacos_secret_key_file":
+				config.SecretKeyFile, err = singleArg(c)
+			case "protocol":
+				if config.Protocol, err = singleArg(c); err == nil && config.Protocol != ProtocolGrpc && config.Protocol != ProtocolHttp {
+					err = c.Errf("unknown protocol '%s'", config.Protocol)
+				}
+			case "nacos_scheme":
+				if config.Scheme, err = singleArg(c); err == nil && config.Scheme != "http" && config.Scheme != "https" {
+					err = c.Errf("unknown scheme '%s'", config.Scheme)
+				}
+			case "nacos_context_path":
+				if config.ContextPath, err = singleArg(c); err == nil && !strings.HasPrefix(config.ContextPath, "/") {
+					err = c.Errf("nacos_context_path '%s' must start with /", config.ContextPath)
+				}
+			case "tls": // tls [CA] or tls CERT KEY [CA]
+				args := c.RemainingArgs()
+				if len(args) > 3 {
+					return &Nacos{}, c.ArgErr()
+				}
+				config.TLS.Enable, config.TLS.Appointed = true, true
+				if len(args) >= 2 {
+					config.TLS.CertFile, config.TLS.KeyFile = args[0], args[1]
+					args = args[2:]
+				}
+				if len(args) == 1 {
+					config.TLS.CaFile = args[0]
+				}
+			case "tls_servername":
+				config.TLS.ServerNameOverride, err = singleArg(c)
+			case "nacos_group":
+				if nacosImpl.Groups = c.RemainingArgs(); len(nacosImpl.Groups) == 0 {
+					err = c.ArgErr()
+				}
+			case "clusters":
+				if nacosImpl.Clusters = c.RemainingArgs(); len(nacosImpl.Clusters) == 0 {
+					err = c.ArgErr()
+				}
+			case "soa":
+				args := c.RemainingArgs()
+				if len(args) != 2 && len(args) != 6 {
+					return &Nacos{}, c.ArgErr()
+				}
+				nacosImpl.SOA.Ns, nacosImpl.SOA.Mbox = dns.Fqdn(args[0]), dns.Fqdn(args[1])
+				if len(args) == 6 {
+					var timers [4]uint32
+					for i, arg := range args[2:] {
+						v, err := strconv.ParseUint(arg, 10, 32)
+						if err != nil {
+							return &Nacos{}, c.Errf("invalid soa value '%s'", arg)
+						}
+						timers[i] = uint32(v)
+					}
+					nacosImpl.SOA.Refresh, nacosImpl.SOA.Retry, nacosImpl.SOA.Expire, nacosImpl.SOA.MinTTL = timers[0], timers[1], timers[2], timers[3]
+				}
+			case "naming_scheme":
+				if nacosImpl.NamingScheme, err = singleArg(c); err == nil && nacosImpl.NamingScheme != SchemeService && nacosImpl.NamingScheme != SchemeServiceGroup {
+					err = c.Errf("unknown naming scheme '%s'", nacosImpl.NamingScheme)
+				}
+			case "cache_ttl", "min_ttl", "max_ttl":
+				var ttl uint32
+				if ttl, err = uint32Arg(c); err != nil {
+					break
+				}
+				switch v {
+				case "cache_ttl":
+					nacosImpl.TTL = ttl
+				case "min_ttl":
+					nacosImpl.MinTTL = ttl
 				default:
-					if c.Val() != "}" {
-						return &Nacos{}, c.Errf("unknown property '%s'", c.Val())
+					nacosImpl.MaxTTL = ttl
+				}
+			case "protect_threshold":
+				var arg string
+				if arg, err = singleArg(c); err != nil {
+					break
+				}
+				threshold, perr := strconv.ParseFloat(arg, 64)
+				if perr != nil || threshold < 0 || threshold > 1 {
+					err = c.Errf("invalid protect_threshold '%s', expected a ratio between 0 and 1", arg)
+				}
+				config.ProtectThreshold = threshold
+			case "lb_policy":
+				if policy, err = singleArg(c); err != nil {
+					break
+				}
+				switch policy {
+				case PolicyAll, PolicyWeightedRandom, PolicyRoundRobin, PolicyWeightedRoundRobin:
+				default:
+					err = c.Errf("unknown lb_policy '%s'", policy)
+				}
+			case "max_answers":
+				if maxAnswers, err = uint32Arg(c); err == nil && maxAnswers == 0 {
+					err = c.Errf("invalid max_answers '0'")
+				}
+			case "site": // site NAME CIDR [CIDR...]
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return &Nacos{}, c.ArgErr()
+				}
+				site := Site{Name: args[0]}
+				for _, cidr := range args[1:] {
+					_, network, perr := net.ParseCIDR(cidr)
+					if perr != nil {
+						return &Nacos{}, c.Errf("invalid site network '%s': %s", cidr, perr)
 					}
+					site.Networks = append(site.Networks, network)
 				}
-
-				if !c.Next() {
+				nacosImpl.Sites = append(nacosImpl.Sites, site)
+			case "health_timeout":
+				var arg string
+				if arg, err = singleArg(c); err != nil {
 					break
 				}
+				timeout, perr := time.ParseDuration(arg)
+				if perr != nil || timeout < 0 {
+					err = c.Errf("invalid health_timeout '%s'", arg)
+				}
+				config.HealthTimeout = timeout
+			case "admin_listen":
+				if adminListen, err = singleArg(c); err == nil {
+					if _, _, perr := net.SplitHostPort(adminListen); perr != nil {
+						err = c.Errf("invalid admin_listen '%s': %s", adminListen, perr)
+					}
+				}
+			case "admin_token":
+				adminToken, err = singleArg(c)
+			case "fallthrough":
+				nacosImpl.Fall.SetZonesFromArgs(c.RemainingArgs())
+			case "cache_dir":
+				config.CachePath, err = singleArg(c)
+			case "log_level":
+				if config.LogLevel, err = singleArg(c); err == nil {
+					if _, ok := logLevels[config.LogLevel]; !ok {
+						err = c.Errf("unknown log_level '%s'", config.LogLevel)
+					}
+				}
+			case "log_path":
+				// logs go to the CoreDNS log now
+				if _, err = singleArg(c); err == nil {
+					log.Warning("log_path is deprecated and ignored")
+				}
+			default:
+				return &Nacos{}, c.Errf("unknown property '%s'", v)
+			}
+			if err != nil {
+				return &Nacos{}, err
 			}
+		}
+	}
+
+	if len(config.ServerHosts) == 0 {
+		return &Nacos{}, c.Err("nacos_server_host is required")
+	}
+	if nacosImpl.MaxTTL > 0 && nacosImpl.MinTTL > nacosImpl.MaxTTL {
+		return &Nacos{}, c.Errf("min_ttl %d is larger than max_ttl %d", nacosImpl.MinTTL, nacosImpl.MaxTTL)
+	}
+
+	if policy != PolicyAll || maxAnswers > 0 {
+		nacosImpl.Balancer = NewBalancer(policy, int(maxAnswers))
+	}
+
+	if adminListen != "" && adminToken == "" {
+		return &Nacos{}, c.Err("admin_listen requires an admin_token")
+	}
 
+	if config.TLS.Enable {
+		if config.Scheme == "http" {
+			return &Nacos{}, c.Errf("tls requires nacos_scheme https")
+		}
+		// the SDK exits the process on unreadable certificates
+		if _, err := config.tlsConfig(); err != nil {
+			return &Nacos{}, c.Errf("invalid tls config: %s", err)
 		}
 	}
 
-	client := NewNacosClient(namespaceId, serverHosts, userName, password)
+	if err := config.loadCredentials(); err != nil {
+		return &Nacos{}, c.Errf("failed to read nacos credentials: %s", err)
+	}
+	if (config.AccessKey == "") != (config.SecretKey == "") {
+		return &Nacos{}, c.Errf("nacos_access_key and nacos_secret_key_file go together")
+	}
+
+	config.Groups = nacosImpl.Groups
+	setLogLevel(config.logLevel())
+	client := NewNacosClient(config)
 	nacosImpl.NacosClientImpl = client
-	nacosImpl.DNSCache = NewConcurrentMap()
-	fmt.Println("nacos plugin init complete, namespaceId: " + namespaceId + ", serverHosts: " + strings.Join(serverHosts, ","))
+	nacosImpl.DNSCache = client.GetDNSCache()
+	if adminListen != "" {
+		nacosImpl.Admin = NewAdminServer(adminListen, adminToken, client)
+	}
+	log.Infof("Initialized for namespace %q, servers: %s", config.NamespaceId, strings.Join(config.ServerHosts, ","))
 	return &nacosImpl, nil
 }
@@ -17,8 +17,10 @@ import (
 	"strings"
 
 	"github.com/coredns/caddy"
+	"github.com/coredns/caddy/caddyfile"
 	os "os"
 	"testing"
+	"time"
 )
 
 func TestNacosParse(t *testing.T) {
@@ -32,6 +34,7 @@ func TestNacosParse(t *testing.T) {
 			`nacos {
 					nacos_namespaceId public
 					nacos_server_host console.nacos.io:8848
+					cache_dir ` + t.TempDir() + `
 				  }
 `, "skydns", "localhost:300", "",
 		},
@@ -41,15 +44,22 @@ func TestNacosParse(t *testing.T) {
 
 	for _, test := range tests {
 		c := caddy.NewTestController("dns", test.input)
-		_, err := NacosParse(c)
+		vs, err := NacosParse(c)
 		if err != nil {
 			t.Error("Failed to get instance.")
 		} else {
-			if strings.Compare(GrpcClient.namespaceId, "") != 0 {
+			// nothing connects before the server starts
+			if vs.NacosClientImpl.naming() != nil {
+				t.Fatal("connected to nacos while parsing")
+			}
+			backend, _ := newBackend(vs.NacosClientImpl.config)
+			defer backend.Close()
+			grpcClient := backend.(*NacosGrpcClient)
+			if strings.Compare(grpcClient.namespaceId, "") != 0 {
 				t.Fatal("Failed")
 			}
 			var passed bool
-			for _, item := range GrpcClient.serverConfigs {
+			for _, item := range grpcClient.serverConfigs {
 				if strings.Compare(item.IpAddr, "console.nacos.io") == 0 && item.Port == 8848 {
 					t.Log("Passed")
 					passed = true
@@ -61,3 +71,293 @@ func TestNacosParse(t *testing.T) {
 		}
 	}
 }
+
+func TestNacosParseProtocol(t *testing.T) {
+	c := caddy.NewTestController("dns", `nacos {
+		nacos_server_host 127.0.0.1:8848
+		protocol http
+		cache_dir `+t.TempDir()+`
+	}`)
+	vs, err := NacosParse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, _ := newBackend(vs.NacosClientImpl.config)
+	if _, ok := backend.(*NacosHttpClient); !ok {
+		t.Fatalf("expected the http backend, got %T", backend)
+	}
+
+	c = caddy.NewTestController("dns", `nacos {
+		protocol udp
+	}`)
+	if _, err := NacosParse(c); err == nil || !strings.Contains(err.Error(), "unknown protocol") {
+		t.Fatalf("expected an unknown protocol error, got %v", err)
+	}
+}
+
+func TestNacosParseTLS(t *testing.T) {
+	server := newFakeNacosTLSServer()
+	defer server.Close()
+	caFile, certFile, keyFile := writeTestCerts(t, server.Server)
+
+	c := caddy.NewTestController("dns", `nacos {
+		nacos_server_host nacos.internal:8848
+		nacos_context_path /registry
+		tls `+certFile+` `+keyFile+` `+caFile+`
+		tls_servername nacos.internal
+		cache_dir `+t.TempDir()+`
+	}`)
+	vs, err := NacosParse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, _ := newBackend(vs.NacosClientImpl.config)
+	// the SDK exits the process when it reconnects after the certificates are removed
+	defer backend.Close()
+	grpcClient := backend.(*NacosGrpcClient)
+	if serverConfig := grpcClient.serverConfigs[0]; serverConfig.Scheme != "https" || serverConfig.ContextPath != "/registry" {
+		t.Fatalf("unexpected server config %+v", serverConfig)
+	}
+	tlsConfig := grpcClient.clientConfig.TLSCfg
+	if !tlsConfig.Enable || !tlsConfig.Appointed || tlsConfig.CaFile != caFile || tlsConfig.CertFile != certFile ||
+		tlsConfig.KeyFile != keyFile || tlsConfig.ServerNameOverride != "nacos.internal" {
+		t.Fatalf("unexpected tls config %+v", tlsConfig)
+	}
+
+	for input, expectedErr := range map[string]string{
+		`nacos {
+			nacos_server_host 127.0.0.1
+			tls /nonexistent/ca.pem
+		}`: "invalid tls config",
+		`nacos {
+			nacos_server_host 127.0.0.1
+			tls ` + keyFile + `
+		}`: "invalid tls config",
+		`nacos {
+			nacos_server_host 127.0.0.1
+			nacos_scheme http
+			tls
+		}`: "tls requires nacos_scheme https",
+		`nacos {
+			nacos_server_host 127.0.0.1
+			nacos_scheme ftp
+		}`: "unknown scheme",
+		`nacos {
+			nacos_server_host 127.0.0.1
+			tls a b c d
+		}`: "Wrong argument count",
+	} {
+		_, err := NacosParse(caddy.NewTestController("dns", input))
+		if err == nil || !strings.Contains(err.Error(), expectedErr) {
+			t.Errorf("expected error %q for %s, got %v", expectedErr, input, err)
+		}
+	}
+}
+
+func TestNacosParseCredentials(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile, secretKeyFile := dir+"/password", dir+"/secret-key"
+	os.WriteFile(passwordFile, []byte("from-file\n"), 0600)
+	os.WriteFile(secretKeyFile, []byte("sk\n"), 0600)
+	os.Setenv("NACOS_TEST_PASSWORD", "from-env")
+	defer os.Unsetenv("NACOS_TEST_PASSWORD")
+
+	tests := []struct {
+		input       string
+		password    string
+		accessKey   string
+		secretKey   string
+		expectedErr string
+	}{
+		{`nacos {
+			nacos_server_host 127.0.0.1
+			nacos_username nacos
+			nacos_password {$NACOS_TEST_PASSWORD}
+			cache_dir ` + dir + `
+		}`, "from-env", "", "", ""},
+		{`nacos {
+			nacos_server_host 127.0.0.1
+			nacos_username nacos
+			nacos_password_file ` + passwordFile + `
+			cache_dir ` + dir + `
+		}`, "from-file", "", "", ""},
+		{`nacos {
+			nacos_server_host 127.0.0.1
+			nacos_access_key ak
+			nacos_secret_key_file ` + secretKeyFile + `
+			cache_dir ` + dir + `
+		}`, "", "ak", "sk", ""},
+		{`nacos {
+			nacos_server_host 127.0.0.1
+			nacos_password_file ` + dir + `/missing
+		}`, "", "", "", "failed to read nacos credentials"},
+		{`nacos {
+			nacos_server_host 127.0.0.1
+			nacos_access_key ak
+		}`, "", "", "", "go together"},
+	}
+
+	for _, test := range tests {
+		vs, err := NacosParse(newCorefileController(t, test.input))
+		if test.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("expected error %q for %s, got %v", test.expectedErr, test.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := vs.NacosClientImpl.config
+		if config.Password != test.password || config.AccessKey != test.accessKey || config.SecretKey != test.secretKey {
+			t.Errorf("unexpected credentials for %s: %+v", test.input, config)
+		}
+	}
+}
+
+// newCorefileController reads the nacos block of a server block like CoreDNS
+// does, expanding {$ENV} placeholders.
+func newCorefileController(t *testing.T, input string) *caddy.Controller {
+	blocks, err := caddyfile.Parse("Corefile", strings.NewReader(". {\n"+input+"\n}"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := caddy.NewTestController("dns", "")
+	c.Dispenser = caddyfile.NewDispenserTokens("Corefile", blocks[0].Tokens["nacos"])
+	c.ServerBlockKeys = blocks[0].Keys
+	return c
+}
+
+func TestNacosParseErrors(t *testing.T) {
+	tests := []struct {
+		input       string
+		expectedErr string
+	}{
+		{"nacos", "nacos_server_host is required"},
+		{"nacos {\n}", "nacos_server_host is required"},
+		{"nacos {\nnacos_server_host\n}", "Wrong argument count"},
+		{"nacos {\nnacos_server_host nacos:port\n}", "invalid nacos_server_host 'nacos:port'"},
+		{"nacos {\nnacos_server_host a:8848,:8848\n}", "invalid nacos_server_host ':8848'"},
+		{"nacos {\nnacos_namespaceId\n}", "Wrong argument count"},
+		{"nacos {\nnacos_namespaceId a b\n}", "Wrong argument count"},
+		{"nacos {\nnacos_username\n}", "Wrong argument count"},
+		{"nacos {\nnacos_password\n}", "Wrong argument count"},
+		{"nacos {\nnacos_password_file\n}", "Wrong argument count"},
+		{"nacos {\nnacos_access_key\n}", "Wrong argument count"},
+		{"nacos {\nnacos_secret_key_file\n}", "Wrong argument count"},
+		{"nacos {\nprotocol\n}", "Wrong argument count"},
+		{"nacos {\nnacos_scheme\n}", "Wrong argument count"},
+		{"nacos {\nnacos_context_path nacos\n}", "must start with /"},
+		{"nacos {\ntls_servername\n}", "Wrong argument count"},
+		{"nacos {\nnacos_group\n}", "Wrong argument count"},
+		{"nacos {\nclusters\n}", "Wrong argument count"},
+		{"nacos {\nsoa ns\n}", "Wrong argument count"},
+		{"nacos {\nsoa ns mbox 1 2 3 x\n}", "invalid soa value 'x'"},
+		{"nacos {\nnaming_scheme\n}", "Wrong argument count"},
+		{"nacos {\nnaming_scheme group\n}", "unknown naming scheme 'group'"},
+		{"nacos {\ncache_ttl\n}", "Wrong argument count"},
+		{"nacos {\ncache_ttl ten\n}", "invalid cache_ttl 'ten'"},
+		{"nacos {\ncache_ttl -1\n}", "invalid cache_ttl '-1'"},
+		{"nacos {\nmin_ttl 4294967296\n}", "invalid min_ttl '4294967296'"},
+		{"nacos {\nmax_ttl\n}", "Wrong argument count"},
+		{"nacos {\nnacos_server_host 127.0.0.1\nmin_ttl 60\nmax_ttl 30\n}", "min_ttl 60 is larger than max_ttl 30"},
+		{"nacos {\nprotect_threshold\n}", "Wrong argument count"},
+		{"nacos {\nprotect_threshold half\n}", "invalid protect_threshold 'half'"},
+		{"nacos {\nprotect_threshold 1.5\n}", "invalid protect_threshold '1.5'"},
+		{"nacos {\nlb_policy\n}", "Wrong argument count"},
+		{"nacos {\nlb_policy random\n}", "unknown lb_policy 'random'"},
+		{"nacos {\nmax_answers\n}", "Wrong argument count"},
+		{"nacos {\nmax_answers 0\n}", "invalid max_answers '0'"},
+		{"nacos {\nmax_answers -1\n}", "invalid max_answers '-1'"},
+		{"nacos {\nsite hz\n}", "Wrong argument count"},
+		{"nacos {\nsite hz 10.0.0.1\n}", "invalid site network '10.0.0.1'"},
+		{"nacos {\nhealth_timeout\n}", "Wrong argument count"},
+		{"nacos {\nhealth_timeout 30\n}", "invalid health_timeout '30'"},
+		{"nacos {\nhealth_timeout -1m\n}", "invalid health_timeout '-1m'"},
+		{"nacos {\nadmin_listen\n}", "Wrong argument count"},
+		{"nacos {\nadmin_listen 8053\n}", "invalid admin_listen '8053'"},
+		{"nacos {\nadmin_token\n}", "Wrong argument count"},
+		{"nacos {\nnacos_server_host 127.0.0.1\nadmin_listen :8053\n}", "admin_listen requires an admin_token"},
+		{"nacos {\ncache_dir\n}", "Wrong argument count"},
+		{"nacos {\nlog_path\n}", "Wrong argument count"},
+		{"nacos {\nlog_level\n}", "Wrong argument count"},
+		{"nacos {\nlog_level trace\n}", "unknown log_level 'trace'"},
+		{"nacos {\nnacos_server\n}", "unknown property 'nacos_server'"},
+	}
+
+	for _, test := range tests {
+		_, err := NacosParse(caddy.NewTestController("dns", test.input))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Errorf("expected error %q for %q, got %v", test.expectedErr, test.input, err)
+		}
+	}
+}
+
+func TestNacosParseValues(t *testing.T) {
+	c := caddy.NewTestController("dns", `nacos svc.local {
+		nacos_server_host 10.0.0.1,nacos.internal:9848 [fd00::1] fd00::2
+		cache_ttl 30
+		min_ttl 5
+		max_ttl 300
+		nacos_group DEFAULT_GROUP PAYMENT_GROUP
+		fallthrough svc.local
+		protect_threshold 0.6
+		lb_policy weighted_round_robin
+		max_answers 2
+		site hz 10.0.0.0/8 fd00::/8
+		site sh 192.168.0.0/16
+		health_timeout 2m
+		log_level warn
+		log_path /var/log/nacos
+		admin_listen 127.0.0.1:8053
+		admin_token secret
+		cache_dir `+t.TempDir()+`
+	}`)
+	vs, err := NacosParse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedHosts := []string{"10.0.0.1:8848", "nacos.internal:9848", "[fd00::1]:8848", "[fd00::2]:8848"}
+	if strings.Join(vs.NacosClientImpl.config.ServerHosts, ",") != strings.Join(expectedHosts, ",") {
+		t.Errorf("expected server hosts %v, got %v", expectedHosts, vs.NacosClientImpl.config.ServerHosts)
+	}
+	if vs.TTL != 30 || vs.MinTTL != 5 || vs.MaxTTL != 300 {
+		t.Errorf("unexpected ttls %d %d %d", vs.TTL, vs.MinTTL, vs.MaxTTL)
+	}
+	if len(vs.Zones) != 1 || vs.Zones[0] != "svc.local." {
+		t.Errorf("unexpected zones %v", vs.Zones)
+	}
+	if vs.NacosClientImpl.config.ProtectThreshold != 0.6 {
+		t.Errorf("unexpected protect threshold %v", vs.NacosClientImpl.config.ProtectThreshold)
+	}
+	if vs.Balancer == nil || vs.Balancer.Policy != PolicyWeightedRoundRobin || vs.Balancer.MaxAnswers != 2 {
+		t.Errorf("unexpected balancer %+v", vs.Balancer)
+	}
+	defer setLogLevel(LevelInfo)
+	if vs.NacosClientImpl.config.LogLevel != LevelWarn || !log.enabled(LevelWarn) || log.enabled(LevelInfo) {
+		t.Errorf("unexpected log level %q", vs.NacosClientImpl.config.LogLevel)
+	}
+	if vs.Admin == nil || vs.Admin.Addr != "127.0.0.1:8053" || vs.Admin.Token != "secret" {
+		t.Errorf("unexpected admin server %+v", vs.Admin)
+	}
+	if strings.Contains(vs.String(), "secret") {
+		t.Errorf("admin token in %s", vs.String())
+	}
+	if vs.NacosClientImpl.config.HealthTimeout != 2*time.Minute {
+		t.Errorf("unexpected health timeout %v", vs.NacosClientImpl.config.HealthTimeout)
+	}
+	if len(vs.Sites) != 2 || vs.Sites.Lookup("fd00::1") != "hz" || vs.Sites.Lookup("192.168.0.1") != "sh" {
+		t.Errorf("unexpected sites %+v", vs.Sites)
+	}
+	if !vs.Fall.Through("orders.svc.local.") || vs.Fall.Through("orders.other.local.") {
+		t.Errorf("unexpected fallthrough zones %v", vs.Fall.Zones)
+	}
+
+	backend, _ := newBackend(vs.NacosClientImpl.config)
+	defer backend.Close()
+	grpcClient := backend.(*NacosGrpcClient)
+	if len(grpcClient.serverConfigs) != 4 || grpcClient.serverConfigs[2].IpAddr != "fd00::1" || grpcClient.serverConfigs[1].Port != 9848 {
+		t.Errorf("unexpected server configs %+v", grpcClient.serverConfigs)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+)
+
+// SnapshotVersion is the format of the snapshots written, snapshots of other
+// versions are ignored.
+const SnapshotVersion = 2
+
+// snapshotInterval is how often the known services are saved.
+var snapshotInterval = 30 * time.Second
+
+// Snapshot is what a client knows about the services of its namespace, saved
+// in CachePath to answer before, or without, Nacos after a restart.
+type Snapshot struct {
+	Version     int                      `json:"version"`
+	Namespace   string                   `json:"namespace"`
+	ServerHosts []string                 `json:"serverHosts"` // sorted, the Nacos cluster of the namespace
+	Groups      []string                 `json:"groups"`      // sorted
+	SavedMillis int64                    `json:"savedMillis"`
+	Names       []string                 `json:"names"`    // services listed by Nacos
+	Services    map[string]model.Service `json:"services"` // by service key, see ServiceKey
+	// 服务自身的元数据, 按服务键
+	Metadata map[string]map[string]string `json:"metadata,omitempty"`
+}
+
+// snapshotPath names the snapshot after the namespace and a hash of the
+// servers and groups, so that blocks of the same namespace on different Nacos
+// clusters sharing cache_dir keep their own snapshot.
+func (vc *NacosClient) snapshotPath() string {
+	namespace := vc.config.NamespaceId
+	if namespace == "" {
+		namespace = "public"
+	}
+	hosts, groups := vc.snapshotSource()
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(hosts, ",") + "|" + strings.Join(groups, ",")))
+	return filepath.Join(vc.config.CachePath, fmt.Sprintf("snapshot-%s-%08x.json", namespace, h.Sum32()))
+}
+
+// snapshotSource returns the sorted servers and groups a snapshot is taken from.
+func (vc *NacosClient) snapshotSource() (hosts, groups []string) {
+	hosts = append(hosts, vc.config.ServerHosts...)
+	sort.Strings(hosts)
+	groups = append(groups, vc.config.Groups...)
+	sort.Strings(groups)
+	return hosts, groups
+}
+
+func (vc *NacosClient) snapshot() Snapshot {
+	snapshot := Snapshot{
+		Version:   SnapshotVersion,
+		Namespace: vc.config.NamespaceId,
+		Services:  make(map[string]model.Service),
+	}
+	snapshot.ServerHosts, snapshot.Groups = vc.snapshotSource()
+
+	vc.allDoms.DLock.RLock()
+	for name := range vc.allDoms.Data {
+		snapshot.Names = append(snapshot.Names, name)
+	}
+	vc.allDoms.DLock.RUnlock()
+	sort.Strings(snapshot.Names)
+
+	for key, item := range vc.serviceMap.Items() {
+		if service, ok := item.(model.Service); ok {
+			snapshot.Services[key] = service
+		}
+	}
+	for key, item := range vc.metadata.Items() {
+		if snapshot.Metadata == nil {
+			snapshot.Metadata = make(map[string]map[string]string)
+		}
+		snapshot.Metadata[key] = item.(map[string]string)
+	}
+	return snapshot
+}
+
+// saveSnapshot replaces the snapshot file by a new one with the known
+// services, unless they did not change since the last one. Clients without a
+// CachePath keep no snapshot.
+func (vc *NacosClient) saveSnapshot() error {
+	snapshot := vc.snapshot()
+	if vc.config.CachePath == "" || len(snapshot.Names) == 0 && len(snapshot.Services) == 0 {
+		return nil
+	}
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(content, vc.lastSnapshot) {
+		return nil
+	}
+
+	snapshot.SavedMillis = CurrentMillis()
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(vc.snapshotPath(), data); err != nil {
+		return err
+	}
+	vc.lastSnapshot = content
+	log.Debugf("Saved %d services to %s", len(snapshot.Services), vc.snapshotPath())
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// to path, readers see the old or the new file but never a partial one.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// loadSnapshot fills the known services from the snapshot file, if there is a
+// valid one for the namespace, servers and groups.
+func (vc *NacosClient) loadSnapshot() {
+	if vc.config.CachePath == "" {
+		return
+	}
+	path := vc.snapshotPath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Failed to read snapshot %s: %s", path, err)
+		}
+		return
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		log.Warningf("Ignoring invalid snapshot %s: %s", path, err)
+		return
+	}
+	hosts, groups := vc.snapshotSource()
+	if snapshot.Version != SnapshotVersion || snapshot.Namespace != vc.config.NamespaceId ||
+		!slices.Equal(snapshot.ServerHosts, hosts) || !slices.Equal(snapshot.Groups, groups) {
+		log.Warningf("Ignoring snapshot %s of version %d, namespace %q, servers %v and groups %v", path,
+			snapshot.Version, snapshot.Namespace, snapshot.ServerHosts, snapshot.Groups)
+		return
+	}
+
+	for key, service := range snapshot.Services {
+		vc.serviceMap.Set(key, service)
+		vc.syncMillis.Set(key, snapshot.SavedMillis)
+	}
+	for key, metadata := range snapshot.Metadata {
+		vc.metadata.Set(key, metadata)
+	}
+	vc.allDoms.DLock.Lock()
+	for _, name := range snapshot.Names {
+		vc.allDoms.Data[name] = true
+	}
+	vc.allDoms.DLock.Unlock()
+	atomic.AddInt64(&vc.listVersion, 1)
+
+	vc.cacheLoaded = len(snapshot.Names) > 0 || len(snapshot.Services) > 0
+	log.Infof("Loaded %d services from snapshot %s saved at %s", len(snapshot.Services), path,
+		time.UnixMilli(snapshot.SavedMillis).Format(time.RFC3339))
+}
+
+func (vc *NacosClient) asyncSaveSnapshot(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(snapshotInterval):
+		}
+		if err := vc.saveSnapshot(); err != nil {
+			log.Warningf("Failed to save snapshot: %s", err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNacosClient_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+	config := NacosClientConfig{NamespaceId: "dev", CachePath: dir, ServerHosts: []string{"10.0.9.2:8848", "10.0.9.1:8848"},
+		Groups: []string{"DEFAULT_GROUP", "PAYMENT_GROUP"}}
+	vc := newNacosClient(config, newFakeBackend(
+		testService("orders", "10.0.0.1", "10.0.0.2"),
+		testGroupService("billing", "PAYMENT_GROUP", "10.0.1.1"),
+	))
+	assert.Regexp(t, `^snapshot-dev-[0-9a-f]{8}\.json$`, filepath.Base(vc.snapshotPath()))
+	assert.Equal(t, dir, filepath.Dir(vc.snapshotPath()))
+
+	// another Nacos cluster of the namespace keeps its own snapshot
+	otherCluster := config
+	otherCluster.ServerHosts = []string{"10.0.8.1:8848"}
+	assert.NotEqual(t, vc.snapshotPath(), newNacosClient(otherCluster, newFakeBackend()).snapshotPath())
+	reordered := config
+	reordered.ServerHosts = []string{"10.0.9.1:8848", "10.0.9.2:8848"}
+	assert.Equal(t, vc.snapshotPath(), newNacosClient(reordered, newFakeBackend()).snapshotPath())
+
+	// nothing known, nothing saved
+	assert.NoError(t, vc.saveSnapshot())
+	_, err := os.Stat(vc.snapshotPath())
+	assert.True(t, os.IsNotExist(err))
+
+	vc.getAllServiceNames()
+	vc.getServiceNow("DEFAULT_GROUP@@orders", &vc.serviceMap, "")
+	assert.NoError(t, vc.saveSnapshot())
+
+	data, err := os.ReadFile(vc.snapshotPath())
+	assert.NoError(t, err)
+	var snapshot Snapshot
+	assert.NoError(t, json.Unmarshal(data, &snapshot))
+	assert.Equal(t, SnapshotVersion, snapshot.Version)
+	assert.Equal(t, "dev", snapshot.Namespace)
+	assert.Equal(t, []string{"10.0.9.1:8848", "10.0.9.2:8848"}, snapshot.ServerHosts)
+	assert.Equal(t, []string{"DEFAULT_GROUP", "PAYMENT_GROUP"}, snapshot.Groups)
+	assert.Equal(t, []string{"DEFAULT_GROUP@@orders", "PAYMENT_GROUP@@billing"}, snapshot.Names)
+	if assert.Contains(t, snapshot.Services, "DEFAULT_GROUP@@orders") {
+		assert.Len(t, snapshot.Services["DEFAULT_GROUP@@orders"].Hosts, 2)
+	}
+
+	// unchanged services are not written again, and no temporary file is left
+	saved := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(vc.snapshotPath(), saved, saved))
+	assert.NoError(t, vc.saveSnapshot())
+	info, err := os.Stat(vc.snapshotPath())
+	if assert.NoError(t, err) {
+		assert.True(t, info.ModTime().Before(time.Now().Add(-time.Minute)))
+	}
+	files, _ := os.ReadDir(dir)
+	assert.Len(t, files, 1)
+
+	vc.getServiceNow("PAYMENT_GROUP@@billing", &vc.serviceMap, "")
+	vc.naming().(*fakeBackend).SetMetadata("PAYMENT_GROUP@@billing", map[string]string{TTLMetadataKey: "45"})
+	vc.refreshMetadata("PAYMENT_GROUP@@billing")
+	assert.NoError(t, vc.saveSnapshot())
+	info, _ = os.Stat(vc.snapshotPath())
+	assert.True(t, info.ModTime().After(time.Now().Add(-time.Minute)))
+
+	// a client restarted while Nacos is down answers from the snapshot
+	down := newFakeBackend()
+	down.SetDown(true)
+	restarted := newNacosClient(config, down)
+	restarted.loadSnapshot()
+	restarted.getAllServiceNames()
+	assert.True(t, restarted.Ready())
+	assert.True(t, restarted.Registered("PAYMENT_GROUP@@billing"))
+
+	vs := &Nacos{
+		Zones:           []string{"svc.local."},
+		Groups:          []string{"DEFAULT_GROUP", "PAYMENT_GROUP"},
+		NamingScheme:    SchemeServiceGroup,
+		NacosClientImpl: restarted,
+		SOA:             DefaultSOAConfig(),
+		TTL:             DefaultTTL,
+	}
+	_, resp := serve(t, vs, "orders.svc.local.", dns.TypeA)
+	assert.Len(t, resp.Answer, 2)
+	_, resp = serve(t, vs, "billing.payment_group.svc.local.", dns.TypeA)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, uint32(45), resp.Answer[0].Header().Ttl)
+	}
+
+	// snapshots of another version or Nacos cluster are ignored
+	other := newNacosClient(config, down)
+	snapshot.Version = SnapshotVersion + 1
+	data, _ = json.Marshal(snapshot)
+	assert.NoError(t, os.WriteFile(other.snapshotPath(), data, 0644))
+	other.loadSnapshot()
+	assert.False(t, other.Ready())
+
+	other = newNacosClient(otherCluster, down)
+	snapshot.Version = SnapshotVersion
+	data, _ = json.Marshal(snapshot)
+	assert.NoError(t, os.WriteFile(other.snapshotPath(), data, 0644))
+	other.loadSnapshot()
+	assert.False(t, other.Ready())
+	assert.Equal(t, 0, other.serviceMap.Count())
+}
+
+func TestNacosClient_SnapshotSubscribeBackoff(t *testing.T) {
+	config := NacosClientConfig{CachePath: t.TempDir()}
+	vc := newNacosClient(config, newFakeBackend(testService("orders", "10.0.0.1")))
+	vc.getAllServiceNames()
+	vc.getServiceNow("DEFAULT_GROUP@@orders", &vc.serviceMap, "")
+	assert.NoError(t, vc.saveSnapshot())
+
+	down := newFakeBackend(testService("orders", "10.0.0.1"))
+	down.SetDown(true)
+	restarted := newNacosClient(config, down)
+	restarted.loadSnapshot()
+	defer restarted.Stop()
+	vs := &Nacos{Zones: []string{"svc.local."}, NacosClientImpl: restarted, SOA: DefaultSOAConfig(), TTL: DefaultTTL}
+
+	// the snapshot answers, subscribing is tried once in the background
+	attempted := func() bool {
+		restarted.subscribeLock.Lock()
+		defer restarted.subscribeLock.Unlock()
+		return restarted.subscribing["DEFAULT_GROUP@@orders"] > 0
+	}
+	for i := 0; i < 10; i++ {
+		_, resp := serve(t, vs, "orders.svc.local.", dns.TypeA)
+		assert.Len(t, resp.Answer, 1)
+		if i == 0 {
+			assert.Eventually(t, attempted, 3*time.Second, 10*time.Millisecond)
+		}
+	}
+	assert.Equal(t, 1, down.subscribeAttempts())
+	assert.False(t, restarted.Subscribed("DEFAULT_GROUP@@orders"))
+
+	// and again by a query once the backoff is over
+	defer func(backoff time.Duration) { subscribeBackoff = backoff }(subscribeBackoff)
+	subscribeBackoff = 0
+	down.SetDown(false)
+	serve(t, vs, "orders.svc.local.", dns.TypeA)
+	assert.Eventually(t, func() bool { return restarted.Subscribed("DEFAULT_GROUP@@orders") }, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, down.subscribeAttempts())
+}
+
+func TestNacosClient_SnapshotOnStop(t *testing.T) {
+	vc := newNacosClient(NacosClientConfig{CachePath: t.TempDir()}, newFakeBackend(testService("orders", "10.0.0.1")))
+	vc.Start()
+	vc.Stop()
+
+	restarted := newNacosClient(vc.config, newFakeBackend())
+	restarted.loadSnapshot()
+	assert.True(t, restarted.Registered("DEFAULT_GROUP@@orders"))
+	assert.Regexp(t, `^snapshot-public-[0-9a-f]{8}\.json$`, filepath.Base(restarted.snapshotPath()))
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/miekg/dns"
+)
+
+// SOAConfig is the SOA record synthesized for the zones of the plugin. Empty
+// names default to ns.dns.<zone> and hostmaster.<zone>.
+type SOAConfig struct {
+	Ns      string
+	Mbox    string
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	MinTTL  uint32 // also the TTL of the SOA record, bounding negative caching
+}
+
+func DefaultSOAConfig() SOAConfig {
+	return SOAConfig{Refresh: 7200, Retry: 1800, Expire: 86400, MinTTL: 30}
+}
+
+// soa returns the SOA record of zone. The serial is the time, in seconds, of
+// the last change pushed by Nacos, so that it increases whenever the answers
+// of the zone may have changed.
+func (vs *Nacos) soa(zone string) *dns.SOA {
+	ns, mbox := vs.SOA.Ns, vs.SOA.Mbox
+	if ns == "" {
+		ns = dnsutil.Join("ns.dns", zone)
+	}
+	if mbox == "" {
+		mbox = dnsutil.Join("hostmaster", zone)
+	}
+
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: vs.SOA.MinTTL},
+		Ns:      ns,
+		Mbox:    mbox,
+		Serial:  uint32(vs.NacosClientImpl.LastPushMillis() / 1000),
+		Refresh: vs.SOA.Refresh,
+		Retry:   vs.SOA.Retry,
+		Expire:  vs.SOA.Expire,
+		Minttl:  vs.SOA.MinTTL,
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 1999-2018 Alibaba Group Holding Ltd.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nacos
+
+import (
+	"strconv"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+)
+
+// TTLMetadataKey is the service or instance metadata overriding the TTL of a
+// service.
+const TTLMetadataKey = "dns.ttl"
+
+// ttl returns the TTL of the answers for hosts of service: the service's
+// cacheMillis, or TTL if it has none, overridden by the dns.ttl of the service
+// metadata, then by the smallest dns.ttl metadata among hosts, and clamped to
+// [MinTTL, MaxTTL].
+func (vs *Nacos) ttl(service model.Service, metadata map[string]string, hosts []model.Instance) uint32 {
+	ttl := vs.TTL
+	if service.CacheMillis > 0 {
+		ttl = uint32((service.CacheMillis + 999) / 1000)
+	}
+	if v, err := strconv.ParseUint(metadata[TTLMetadataKey], 10, 32); err == nil {
+		ttl = uint32(v)
+	}
+
+	override := false
+	for _, host := range hosts {
+		v, err := strconv.ParseUint(host.Metadata[TTLMetadataKey], 10, 32)
+		if err != nil {
+			continue
+		}
+		if !override || uint32(v) < ttl {
+			ttl, override = uint32(v), true
+		}
+	}
+
+	if ttl < vs.MinTTL {
+		ttl = vs.MinTTL
+	}
+	if vs.MaxTTL > 0 && ttl > vs.MaxTTL {
+		ttl = vs.MaxTTL
+	}
+	return ttl
+}
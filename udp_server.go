@@ -14,18 +14,26 @@
 package nacos
 
 import (
+	"context"
 	json "encoding/json"
+	"errors"
 	"math/rand"
 	"net"
-	"os"
 	"strconv"
 	"time"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
 )
 
+// UDPServer receives the service changes Nacos 1.x pushes to the udpPort a
+// client advertises when listing instances, see NacosHttpClient.
 type UDPServer struct {
-	port      int
-	host      string
-	vipClient *NacosClient
+	port    int
+	host    string
+	conn    *net.UDPConn
+	receive func(service model.Service)
+	// 只接受来自 Nacos 服务端的推送, 为 nil 时全部丢弃
+	allow func(ip net.IP) bool
 }
 
 type PushData struct {
@@ -41,81 +49,99 @@ func getUdpPort() int {
 func (us *UDPServer) tryListen() (*net.UDPConn, bool) {
 	addr, err := net.ResolveUDPAddr("udp", us.host+":"+strconv.Itoa(us.port))
 	if err != nil {
-		NacosClientLogger.Error("Can't resolve address: ", err)
+		log.Errorf("Can't resolve address: %s", err)
 		return nil, false
 	}
 
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		NacosClientLogger.Error("Error listening:", err)
+		log.Errorf("Error listening: %s", err)
 		return nil, false
 	}
 
 	return conn, true
 }
 
-func (us *UDPServer) SetNacosClient(nc *NacosClient) {
-	us.vipClient = nc
+// StartServer receives pushes until ctx is done.
+func (us *UDPServer) StartServer(ctx context.Context) {
+	if us.Listen() {
+		us.Serve(ctx)
+	}
 }
 
-func (us *UDPServer) StartServer() {
-	var conn *net.UDPConn
-
+// Listen binds a random port, which is Port afterwards.
+func (us *UDPServer) Listen() bool {
 	for i := 0; i < 3; i++ {
 		r := rand.New(rand.NewSource(time.Now().UnixNano()))
 		port := r.Intn(1000) + 54951
 		us.port = port
-		conn1, ok := us.tryListen()
+		conn, ok := us.tryListen()
 
 		if ok {
-			conn = conn1
-			NacosClientLogger.Info("udp server start, port: " + strconv.Itoa(port))
-			break
-		}
-
-		if !ok && i == 2 {
-			NacosClientLogger.Critical("failed to start udp server after trying 3 times.")
-			os.Exit(1)
+			us.conn = conn
+			log.Infof("UDP server started, port: %d", port)
+			return true
 		}
 	}
 
-	UDP_Port = us.port
+	log.Error("Failed to start UDP server after trying 3 times")
+	return false
+}
+
+func (us *UDPServer) Port() int {
+	return us.port
+}
+
+// Serve handles the pushes received by Listen until ctx is done.
+func (us *UDPServer) Serve(ctx context.Context) {
+	// unblocks ReadFromUDP
+	go func() {
+		<-ctx.Done()
+		us.conn.Close()
+	}()
 
-	defer conn.Close()
-	for {
-		us.handleClient(conn)
+	for ctx.Err() == nil {
+		us.handleClient(us.conn)
 	}
+	log.Infof("UDP server stopped, port: %d", us.port)
 }
 
 func (us *UDPServer) handleClient(conn *net.UDPConn) {
 	data := make([]byte, 4024)
 	n, remoteAddr, err := conn.ReadFromUDP(data)
 	if err != nil {
-		NacosClientLogger.Error("failed to read UDP msg because of ", err)
+		if !errors.Is(err, net.ErrClosed) {
+			log.Errorf("Failed to read UDP message: %s", err)
+		}
+		return
+	}
+	// anyone reaching the port could forge a push, only the servers may push
+	if us.allow == nil || !us.allow(remoteAddr.IP) {
+		log.Warningf("Ignored push from %s, not a nacos server", remoteAddr)
 		return
 	}
 
 	s := TryDecompressData(data[:n])
 
-	NacosClientLogger.Info("receive push: "+s+" from: ", remoteAddr)
+	log.Debugf("Received push %s from %s", s, remoteAddr)
 
 	var pushData PushData
 	err1 := json.Unmarshal([]byte(s), &pushData)
 	if err1 != nil {
-		NacosClientLogger.Warn("failed to process push data, ", err1)
+		log.Warningf("Failed to process push data: %s", err1)
 		return
 	}
 
 	service, err1 := ProcessDomainString(pushData.Data)
-	NacosClientLogger.Info("receive service: ", service)
+	log.Debugf("Received service: %v", service)
 
 	if err1 != nil {
-		NacosClientLogger.Warn("failed to process push data: "+s, err1)
+		log.Warningf("Failed to process push data %s: %s", s, err1)
 	}
 
-	key := GetCacheKey(service.Name, LocalIP())
-
-	us.vipClient.serviceMap.Set(key, service)
+	if service.Name != "" && us.receive != nil {
+		us.receive(service)
+	}
 
 	ack := make(map[string]string)
 	ack["type"] = "push-ack"
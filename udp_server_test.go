@@ -14,32 +14,93 @@
 package nacos
 
 import (
+	"context"
+	"encoding/json"
 	"net"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestUDPServer_StartServer(t *testing.T) {
-	s := `{"dom":"hello123","cacheMillis":10000,"useSpecifiedURL":false,"hosts":[{"valid":true,"marked":false,"metadata":{},"instanceId":"","port":80,"ip":"2.2.2.2","weight":1.0,"enabled":true}],"checksum":"c7befb32f3bb5b169f76efbb0e1f79eb1542236821437","lastRefTime":1542236821437,"env":"","clusters":""}`
-	us := UDPServer{}
-	//us.vipClient = &NacosClient{NewConcurrentMap(), UDPServer{}, ServerManager{}, 8848}
-	us.vipClient = &NacosClient{NewConcurrentMap(), UDPServer{}}
-	go us.StartServer()
+	s := `{"name":"DEFAULT_GROUP@@hello123","cacheMillis":10000,"useSpecifiedURL":false,"hosts":[{"valid":true,"marked":false,"metadata":{},"instanceId":"","port":80,"ip":"2.2.2.2","weight":1.0,"enabled":true}],"checksum":"c7befb32f3bb5b169f76efbb0e1f79eb1542236821437","lastRefTime":1542236821437,"env":"","clusters":""}`
+	push, _ := json.Marshal(PushData{PushType: "dom", Data: s, LastRefTime: 1542236821437})
+	received := make(chan model.Service, 1)
+	us := UDPServer{
+		receive: func(service model.Service) { received <- service },
+		allow:   func(ip net.IP) bool { return ip.IsLoopback() },
+	}
+	assert.True(t, us.Listen())
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		us.Serve(ctx)
+		close(stopped)
+	}()
 
-	time.Sleep(100000)
 	sip := net.ParseIP("127.0.0.1")
 	srcAddr := &net.UDPAddr{IP: net.IPv4zero, Port: 0}
-	dstAddr := &net.UDPAddr{IP: sip, Port: us.port}
+	dstAddr := &net.UDPAddr{IP: sip, Port: us.Port()}
 	conn, err := net.DialUDP("udp", srcAddr, dstAddr)
 	if err != nil {
-		t.Error("Udp server test failed")
+		t.Fatal("Udp server test failed")
+	}
+	defer conn.Close()
+	conn.Write(push)
+	data := make([]byte, 4024)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, _ := conn.ReadFromUDP(data)
+	assert.True(t, strings.Contains(string(data[:n]), "push-ack"))
+
+	select {
+	case service := <-received:
+		assert.Equal(t, "DEFAULT_GROUP@@hello123", service.Name)
+		if assert.Len(t, service.Hosts, 1) {
+			assert.Equal(t, "2.2.2.2", service.Hosts[0].Ip)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("push was not received")
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Error("udp server did not stop after cancel")
+	}
+}
+
+func TestUDPServer_UnknownSender(t *testing.T) {
+	s := `{"name":"DEFAULT_GROUP@@hello123","hosts":[{"valid":true,"metadata":{},"port":80,"ip":"6.6.6.6","weight":1.0,"enabled":true}],"lastRefTime":1542236821437}`
+	push, _ := json.Marshal(PushData{PushType: "dom", Data: s, LastRefTime: 1542236821437})
+	received := make(chan model.Service, 1)
+	// only 10.0.0.1 is a nacos server, the push comes from 127.0.0.1
+	us := UDPServer{
+		receive: func(service model.Service) { received <- service },
+		allow:   func(ip net.IP) bool { return ip.Equal(net.ParseIP("10.0.0.1")) },
+	}
+	assert.True(t, us.Listen())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go us.Serve(ctx)
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: us.Port()})
+	if err != nil {
+		t.Fatal("Udp server test failed")
 	}
 	defer conn.Close()
-	conn.Write([]byte(s))
+	conn.Write(push)
 	data := make([]byte, 4024)
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
 	n, _, _ := conn.ReadFromUDP(data)
-	if strings.Contains(string(data[:n]), "push-ack") {
-		t.Log("Udp server test passed.")
+	assert.Zero(t, n, "push from an unknown source was acknowledged")
+
+	select {
+	case service := <-received:
+		t.Errorf("push from an unknown source was received: %v", service)
+	default:
 	}
 }
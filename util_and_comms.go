@@ -18,21 +18,44 @@ import (
 	"compress/gzip"
 	"io/ioutil"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var (
 	DefaultCacheMillis = int64(5000)
 	Version            = "Nacos-DNS:v1.0.1"
-	CachePath          string
-	LogPath            string
 	SEPERATOR          = "@@"
 	GZIP_MAGIC         = []byte("\x1F\x8B")
 	EnableReceivePush  = true
-	UDP_Port           = -1
 	SERVER_PORT        = "8848"
 )
 
+// parseServerHost splits a Nacos server address, host or host:port with IPv6
+// hosts in brackets, defaulting to SERVER_PORT.
+func parseServerHost(serverHost string) (host string, port uint64, err error) {
+	serverHost = strings.TrimSpace(serverHost)
+	host, portString := serverHost, SERVER_PORT
+	switch {
+	case strings.HasPrefix(serverHost, "[") && strings.HasSuffix(serverHost, "]"):
+		host = serverHost[1 : len(serverHost)-1]
+	case strings.Count(serverHost, ":") == 1 || strings.HasPrefix(serverHost, "["):
+		if host, portString, err = net.SplitHostPort(serverHost); err != nil {
+			return "", 0, err
+		}
+	}
+	// more than one colon without brackets is a bare IPv6 address
+
+	if host == "" {
+		return "", 0, NacosClientError{"missing host"}
+	}
+	if port, err = strconv.ParseUint(portString, 10, 16); err != nil || port == 0 {
+		return "", 0, NacosClientError{"invalid port '" + portString + "'"}
+	}
+	return host, port, nil
+}
+
 func CurrentMillis() int64 {
 	return time.Now().UnixNano() / 1e6
 }
@@ -46,7 +69,7 @@ func TryDecompressData(data []byte) string {
 	reader, err := gzip.NewReader(bytes.NewReader(data))
 
 	if err != nil {
-		NacosClientLogger.Warn("failed to decompress gzip data", err)
+		log.Warningf("Failed to decompress gzip data: %s", err)
 		return ""
 	}
 
@@ -54,7 +77,7 @@ func TryDecompressData(data []byte) string {
 	bs, err1 := ioutil.ReadAll(reader)
 
 	if err1 != nil {
-		NacosClientLogger.Warn("failed to decompress gzip data", err1)
+		log.Warningf("Failed to decompress gzip data: %s", err1)
 		return ""
 	}
 
@@ -32,3 +32,39 @@ func TestTryDecompressData(t *testing.T) {
 		t.Log("Gzip test is passed.")
 	}
 }
+
+func TestParseServerHost(t *testing.T) {
+	tests := []struct {
+		serverHost string
+		host       string
+		port       uint64
+		err        bool
+	}{
+		{"console.nacos.io:8848", "console.nacos.io", 8848, false},
+		{"console.nacos.io", "console.nacos.io", 8848, false},
+		{" 10.0.0.1:9848 ", "10.0.0.1", 9848, false},
+		{"[fd00::1]:9848", "fd00::1", 9848, false},
+		{"[fd00::1]", "fd00::1", 8848, false},
+		{"fd00::1", "fd00::1", 8848, false},
+		{"", "", 0, true},
+		{":8848", "", 0, true},
+		{"console.nacos.io:", "", 0, true},
+		{"console.nacos.io:port", "", 0, true},
+		{"console.nacos.io:65536", "", 0, true},
+		{"console.nacos.io:0", "", 0, true},
+		{"[fd00::1]:", "", 0, true},
+	}
+
+	for _, test := range tests {
+		host, port, err := parseServerHost(test.serverHost)
+		if test.err {
+			if err == nil {
+				t.Errorf("expected an error for '%s'", test.serverHost)
+			}
+			continue
+		}
+		if err != nil || host != test.host || port != test.port {
+			t.Errorf("parseServerHost(%q) = %q, %d, %v", test.serverHost, host, port, err)
+		}
+	}
+}
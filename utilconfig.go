@@ -25,7 +25,9 @@ import (
 )
 
 var DNSDomains = make(map[string]string)
-var DNSTTL uint32 = 1
+
+// DefaultTTL is the TTL of services which do not set cacheMillis.
+const DefaultTTL uint32 = 1
 
 func Exist(path string) bool {
 	_, err := os.Stat(path)